@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+var adminCmd = &cobra.Command{
+	Use:           "admin",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "administrative commands",
+}
+
+var adminMigrateCmd = &cobra.Command{
+	Use:           "migrate <from-fingerprint> <to-fingerprint>",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "move machine secrets to another fingerprint",
+	Args:          cobra.ExactArgs(2),
+	RunE: func(_ *cobra.Command, args []string) error {
+		lupac, cleanup, err := dial()
+		if err != nil {
+			return fmt.Errorf("dial failed: %w", err)
+		}
+		defer cleanup()
+
+		if err := lupac.AdminMigrate(args[0], args[1]); err != nil {
+			return fmt.Errorf("migrate failed: %w", err)
+		}
+
+		fmt.Printf("migrated: %s -> %s\n", args[0], args[1])
+		return nil
+	},
+}
+
+var adminRevokeCmd = &cobra.Command{
+	Use:           "revoke <fingerprint|cert> <value> | revoke serial <ca fingerprint|ca.pub> <serial>",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "revoke a key fingerprint, certificate serial of a CA or certificate file",
+	Args:          cobra.RangeArgs(2, 3),
+	RunE: func(_ *cobra.Command, args []string) error {
+		value, err := revocationValue(args[0], args[1:])
+		if err != nil {
+			return err
+		}
+
+		lupac, cleanup, err := dial()
+		if err != nil {
+			return fmt.Errorf("dial failed: %w", err)
+		}
+		defer cleanup()
+
+		if err := lupac.Revoke(args[0], value); err != nil {
+			return fmt.Errorf("revoke failed: %w", err)
+		}
+
+		fmt.Printf("revoked: %s %s\n", args[0], strings.Join(args[1:], " "))
+		return nil
+	},
+}
+
+var adminUnrevokeCmd = &cobra.Command{
+	Use:           "unrevoke <fingerprint|cert> <value> | unrevoke serial <ca fingerprint|ca.pub> <serial>",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "remove an entry from the revocation list",
+	Args:          cobra.RangeArgs(2, 3),
+	RunE: func(_ *cobra.Command, args []string) error {
+		value, err := revocationValue(args[0], args[1:])
+		if err != nil {
+			return err
+		}
+
+		lupac, cleanup, err := dial()
+		if err != nil {
+			return fmt.Errorf("dial failed: %w", err)
+		}
+		defer cleanup()
+
+		if err := lupac.Unrevoke(args[0], value); err != nil {
+			return fmt.Errorf("unrevoke failed: %w", err)
+		}
+
+		fmt.Printf("unrevoked: %s %s\n", args[0], strings.Join(args[1:], " "))
+		return nil
+	},
+}
+
+var adminRevocationsCmd = &cobra.Command{
+	Use:           "revocations [fingerprint|serial]",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "list revoked entries",
+	Args:          cobra.MaximumNArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		var kind string
+		if len(args) > 0 {
+			kind = args[0]
+		}
+
+		lupac, cleanup, err := dial()
+		if err != nil {
+			return fmt.Errorf("dial failed: %w", err)
+		}
+		defer cleanup()
+
+		entries, err := lupac.Revocations(kind)
+		if err != nil {
+			return fmt.Errorf("list failed: %w", err)
+		}
+
+		for _, entry := range entries {
+			fmt.Println(entry)
+		}
+		return nil
+	},
+}
+
+var adminBansCmd = &cobra.Command{
+	Use:           "bans [addr]",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "list banned source addresses",
+	Args:          cobra.MaximumNArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		var addr string
+		if len(args) > 0 {
+			addr = args[0]
+		}
+
+		lupac, cleanup, err := dial()
+		if err != nil {
+			return fmt.Errorf("dial failed: %w", err)
+		}
+		defer cleanup()
+
+		bans, err := lupac.Bans(addr)
+		if err != nil {
+			return fmt.Errorf("list bans failed: %w", err)
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(bans)
+	},
+}
+
+var adminUnbanCmd = &cobra.Command{
+	Use:           "unban <addr>",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "lift the ban of a source address",
+	Args:          cobra.ExactArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		lupac, cleanup, err := dial()
+		if err != nil {
+			return fmt.Errorf("dial failed: %w", err)
+		}
+		defer cleanup()
+
+		if err := lupac.Unban(args[0]); err != nil {
+			return fmt.Errorf("unban failed: %w", err)
+		}
+
+		fmt.Printf("%s unbanned\n", args[0])
+		return nil
+	},
+}
+
+func init() {
+	adminCmd.AddCommand(
+		adminMigrateCmd,
+		adminRevokeCmd,
+		adminUnrevokeCmd,
+		adminRevocationsCmd,
+		adminPolicyCmd,
+		adminLabelsCmd,
+		adminSourcesCmd,
+		adminBansCmd,
+		adminUnbanCmd,
+		adminAuditCmd,
+	)
+}
+
+// revocationValue returns the revocation list value of the args: certificate files are read,
+// serials are scoped to the CA given by fingerprint or public key file.
+func revocationValue(kind string, args []string) (string, error) {
+	switch kind {
+	case "serial":
+		if len(args) != 2 {
+			return "", errors.New("serial revocation requires the CA and the serial")
+		}
+
+		caFp := args[0]
+		if !strings.HasPrefix(caFp, "SHA256:") {
+			caKey, err := loadPublicKey(caFp)
+			if err != nil {
+				return "", fmt.Errorf("invalid CA: %w", err)
+			}
+			caFp = ssh.FingerprintSHA256(caKey)
+		}
+
+		return caFp + " " + args[1], nil
+	case "cert":
+		if len(args) != 1 {
+			return "", errors.New("certificate revocation requires the certificate file only")
+		}
+
+		certBytes, err := os.ReadFile(args[0])
+		if err != nil {
+			return "", fmt.Errorf("unable to read certificate: %w", err)
+		}
+
+		return strings.TrimSpace(string(certBytes)), nil
+	default:
+		if len(args) != 1 {
+			return "", fmt.Errorf("%s revocation requires a single value", kind)
+		}
+
+		return args[0], nil
+	}
+}
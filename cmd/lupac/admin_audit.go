@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/buglloc/lupa/pkg/lupa"
+)
+
+var adminAuditArgs struct {
+	MachineFP string
+	KeyID     string
+	Type      string
+	Outcome   string
+	Since     string
+	Until     string
+	Cursor    uint64
+	Limit     uint32
+	All       bool
+}
+
+var adminAuditCmd = &cobra.Command{
+	Use:           "audit",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "query the server audit log",
+	Args:          cobra.NoArgs,
+	RunE: func(_ *cobra.Command, _ []string) error {
+		since, err := parseAuditTime(adminAuditArgs.Since)
+		if err != nil {
+			return fmt.Errorf("invalid --since: %w", err)
+		}
+
+		until, err := parseAuditTime(adminAuditArgs.Until)
+		if err != nil {
+			return fmt.Errorf("invalid --until: %w", err)
+		}
+
+		lupac, cleanup, err := dial()
+		if err != nil {
+			return fmt.Errorf("dial failed: %w", err)
+		}
+		defer cleanup()
+
+		q := lupa.AuditQuery{
+			MachineFP: adminAuditArgs.MachineFP,
+			KeyID:     adminAuditArgs.KeyID,
+			Type:      adminAuditArgs.Type,
+			Outcome:   adminAuditArgs.Outcome,
+			Since:     since,
+			Until:     until,
+			Cursor:    adminAuditArgs.Cursor,
+			Limit:     adminAuditArgs.Limit,
+		}
+
+		var page struct {
+			Records    []lupa.AuditRecord `json:"records"`
+			NextCursor uint64             `json:"next_cursor"`
+		}
+		page.Records = make([]lupa.AuditRecord, 0)
+		for {
+			records, next, err := lupac.AuditQuery(q)
+			if err != nil {
+				return fmt.Errorf("audit query failed: %w", err)
+			}
+
+			page.Records = append(page.Records, records...)
+			page.NextCursor = next
+			if !adminAuditArgs.All || next == 0 {
+				break
+			}
+
+			q.Cursor = next
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(page)
+	},
+}
+
+func init() {
+	flags := adminAuditCmd.Flags()
+	flags.StringVar(&adminAuditArgs.MachineFP, "machine", "", "machine fingerprint")
+	flags.StringVar(&adminAuditArgs.KeyID, "key-id", "", "key ID")
+	flags.StringVar(&adminAuditArgs.Type, "type", "", "request type (get, put, admin-revoke, ...)")
+	flags.StringVar(&adminAuditArgs.Outcome, "outcome", "", "request outcome (ok or error)")
+	flags.StringVar(&adminAuditArgs.Since, "since", "", "records at or after the time (RFC3339 or duration ago, e.g. 24h)")
+	flags.StringVar(&adminAuditArgs.Until, "until", "", "records before the time (RFC3339 or duration ago, e.g. 1h)")
+	flags.Uint64Var(&adminAuditArgs.Cursor, "cursor", 0, "return records after the cursor (next_cursor of the previous page)")
+	flags.Uint32Var(&adminAuditArgs.Limit, "limit", 0, "records per page (server default if zero)")
+	flags.BoolVar(&adminAuditArgs.All, "all", false, "fetch all pages")
+}
+
+func parseAuditTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/buglloc/lupa/pkg/lupa"
+)
+
+var adminPolicySetArgs struct {
+	Namespace string
+	Subjects  []string
+	Prefixes  []string
+	Read      bool
+	Write     bool
+}
+
+var adminPolicyCmd = &cobra.Command{
+	Use:           "policy",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "manage shared namespace access policies",
+}
+
+var adminPolicySetCmd = &cobra.Command{
+	Use:           "set <name>",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "create or replace access rule",
+	Args:          cobra.ExactArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		lupac, cleanup, err := dial()
+		if err != nil {
+			return fmt.Errorf("dial failed: %w", err)
+		}
+		defer cleanup()
+
+		err = lupac.SetPolicy(lupa.PolicyRule{
+			Name:      args[0],
+			Namespace: adminPolicySetArgs.Namespace,
+			Subjects:  adminPolicySetArgs.Subjects,
+			Prefixes:  adminPolicySetArgs.Prefixes,
+			Read:      adminPolicySetArgs.Read,
+			Write:     adminPolicySetArgs.Write,
+		})
+		if err != nil {
+			return fmt.Errorf("set policy failed: %w", err)
+		}
+
+		fmt.Printf("policy %q saved\n", args[0])
+		return nil
+	},
+}
+
+var adminPolicyDeleteCmd = &cobra.Command{
+	Use:           "delete <name>",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "delete access rule",
+	Args:          cobra.ExactArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		lupac, cleanup, err := dial()
+		if err != nil {
+			return fmt.Errorf("dial failed: %w", err)
+		}
+		defer cleanup()
+
+		if err := lupac.DeletePolicy(args[0]); err != nil {
+			return fmt.Errorf("delete policy failed: %w", err)
+		}
+
+		fmt.Printf("policy %q deleted\n", args[0])
+		return nil
+	},
+}
+
+var adminPolicyListCmd = &cobra.Command{
+	Use:           "list [namespace]",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "list access rules and machine labels",
+	Args:          cobra.MaximumNArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		var namespace string
+		if len(args) > 0 {
+			namespace = args[0]
+		}
+
+		lupac, cleanup, err := dial()
+		if err != nil {
+			return fmt.Errorf("dial failed: %w", err)
+		}
+		defer cleanup()
+
+		policies, err := lupac.Policies(namespace)
+		if err != nil {
+			return fmt.Errorf("list policies failed: %w", err)
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(policies)
+	},
+}
+
+var adminLabelsCmd = &cobra.Command{
+	Use:           "labels <machine-fingerprint> [label...]",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "replace machine labels, no labels removes them",
+	Args:          cobra.MinimumNArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		lupac, cleanup, err := dial()
+		if err != nil {
+			return fmt.Errorf("dial failed: %w", err)
+		}
+		defer cleanup()
+
+		if err := lupac.SetLabels(args[0], args[1:]); err != nil {
+			return fmt.Errorf("set labels failed: %w", err)
+		}
+
+		fmt.Printf("labels of %s saved\n", args[0])
+		return nil
+	},
+}
+
+func init() {
+	flags := adminPolicySetCmd.Flags()
+	flags.StringVar(&adminPolicySetArgs.Namespace, "namespace", "", "shared namespace")
+	flags.StringSliceVar(&adminPolicySetArgs.Subjects, "subject", nil, "allowed subject: fp:<fingerprint>, label:<label> or principal:<principal>")
+	flags.StringSliceVar(&adminPolicySetArgs.Prefixes, "prefix", nil, "allowed key prefix (all keys by default)")
+	flags.BoolVar(&adminPolicySetArgs.Read, "read", false, "allow reading")
+	flags.BoolVar(&adminPolicySetArgs.Write, "write", false, "allow writing")
+	_ = adminPolicySetCmd.MarkFlagRequired("namespace")
+	_ = adminPolicySetCmd.MarkFlagRequired("subject")
+
+	adminPolicyCmd.AddCommand(
+		adminPolicySetCmd,
+		adminPolicyDeleteCmd,
+		adminPolicyListCmd,
+	)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var adminSourcesCmd = &cobra.Command{
+	Use:           "sources",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "manage machine source address restrictions",
+}
+
+var adminSourcesSetCmd = &cobra.Command{
+	Use:           "set <machine-fingerprint> [cidr...]",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "replace machine allowlist, no CIDRs removes it",
+	Args:          cobra.MinimumNArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		lupac, cleanup, err := dial()
+		if err != nil {
+			return fmt.Errorf("dial failed: %w", err)
+		}
+		defer cleanup()
+
+		if err := lupac.SetSources(args[0], args[1:]); err != nil {
+			return fmt.Errorf("set sources failed: %w", err)
+		}
+
+		fmt.Printf("sources of %s saved\n", args[0])
+		return nil
+	},
+}
+
+var adminSourcesUnpinCmd = &cobra.Command{
+	Use:           "unpin <machine-fingerprint>",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "forget the network machine was pinned to",
+	Args:          cobra.ExactArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		lupac, cleanup, err := dial()
+		if err != nil {
+			return fmt.Errorf("dial failed: %w", err)
+		}
+		defer cleanup()
+
+		if err := lupac.UnpinSource(args[0]); err != nil {
+			return fmt.Errorf("unpin failed: %w", err)
+		}
+
+		fmt.Printf("%s unpinned\n", args[0])
+		return nil
+	},
+}
+
+var adminSourcesListCmd = &cobra.Command{
+	Use:           "list [machine-fingerprint]",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "list machine source restrictions",
+	Args:          cobra.MaximumNArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		var machineFP string
+		if len(args) > 0 {
+			machineFP = args[0]
+		}
+
+		lupac, cleanup, err := dial()
+		if err != nil {
+			return fmt.Errorf("dial failed: %w", err)
+		}
+		defer cleanup()
+
+		sources, err := lupac.Sources(machineFP)
+		if err != nil {
+			return fmt.Errorf("list sources failed: %w", err)
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(sources)
+	},
+}
+
+func init() {
+	adminSourcesCmd.AddCommand(
+		adminSourcesSetCmd,
+		adminSourcesUnpinCmd,
+		adminSourcesListCmd,
+	)
+}
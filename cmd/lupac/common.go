@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"io/fs"
 	"net"
 	"os"
+	"path/filepath"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -12,49 +14,123 @@ import (
 )
 
 func dial() (*lupa.Client, func(), error) {
-	privBytes, err := os.ReadFile(rootArgs.PrivateKey)
+	addr, hostCfg, err := resolveAddr(rootArgs.RemoteAddr)
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to read private key file: %w", err)
+		return nil, nil, err
 	}
 
-	signer, err := ssh.ParsePrivateKey(privBytes)
+	checkHostKey, err := hostKeyCallback()
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to create private key signer: %w", err)
+		return nil, nil, err
+	}
+
+	signer, closeSigner, err := loadIdentity(hostCfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user := rootArgs.User
+	if user == "" {
+		user = ssh.FingerprintSHA256(signer.PublicKey())
 	}
 
 	config := &ssh.ClientConfig{
-		User:    ssh.FingerprintSHA256(signer.PublicKey()),
+		User:    user,
 		Timeout: 5 * time.Second,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
-		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
-			if rootArgs.RemoteFingerprint == "" {
-				return nil
-			}
-
-			actualFp := ssh.FingerprintSHA256(key)
-			if rootArgs.RemoteFingerprint == actualFp {
-				return nil
-			}
-
-			return fmt.Errorf("remote host key mismatch: %q (expected) != %q (actual)", rootArgs.RemoteFingerprint, actualFp)
-		},
+		HostKeyCallback: checkHostKey,
 	}
 
-	conn, err := ssh.Dial("tcp", rootArgs.RemoteAddr, config)
+	conn, err := ssh.Dial("tcp", addr, config)
 	if err != nil {
+		closeSigner()
 		return nil, nil, fmt.Errorf("unable to connect: %w", err)
 	}
 
 	lupac, err := lupa.NewClient(conn)
 	if err != nil {
+		_ = conn.Close()
+		closeSigner()
 		return nil, nil, fmt.Errorf("unable to create lupa client: %w", err)
 	}
 
 	closeFn := func() {
 		_ = lupac.Close()
 		_ = conn.Close()
+		closeSigner()
 	}
 	return lupac, closeFn, nil
 }
+
+// resolveAddr applies HostName and Port of --ssh-config to the host of addr,
+// the port defaults to 2022 if neither addr nor config have it.
+func resolveAddr(addr string) (string, sshHostConfig, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+		port = ""
+	}
+
+	var hostCfg sshHostConfig
+	if rootArgs.SSHConfig != "" {
+		hostCfg, err = loadSSHConfig(rootArgs.SSHConfig, host)
+		if err != nil {
+			return "", hostCfg, err
+		}
+	}
+
+	if hostCfg.HostName != "" {
+		host = hostCfg.HostName
+	}
+
+	if port == "" {
+		port = hostCfg.Port
+	}
+
+	if port == "" {
+		port = "2022"
+	}
+
+	return net.JoinHostPort(host, port), hostCfg, nil
+}
+
+// writeFileAtomic replaces the file with data through a temporary file in the same directory,
+// uid and gid of -1 keep the current owner.
+func writeFileAtomic(path string, data []byte, mode fs.FileMode, uid int, gid int) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	err = func() error {
+		defer func() { _ = tmp.Close() }()
+
+		if err := tmp.Chmod(mode); err != nil {
+			return err
+		}
+
+		if uid >= 0 || gid >= 0 {
+			if err := tmp.Chown(uid, gid); err != nil {
+				return err
+			}
+		}
+
+		if _, err := tmp.Write(data); err != nil {
+			return err
+		}
+
+		return tmp.Sync()
+	}()
+	if err != nil {
+		return fmt.Errorf("unable to write temporary file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("unable to replace output file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type envVar struct {
+	Name  string
+	Value string
+}
+
+// parseEnvFile parses .env file: NAME=value lines with optional "export " prefix and # comments.
+// Values may be single quoted (literal) or double quoted (with \n, \r, \t, \" and \\ escapes),
+// quoted values may span multiple lines.
+func parseEnvFile(data string) ([]envVar, error) {
+	var out []envVar
+	seen := make(map[string]int)
+	lines := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !envNameRe.MatchString(name) {
+			return nil, fmt.Errorf("line %d: NAME=value expected", lineNo)
+		}
+
+		if prev, dup := seen[name]; dup {
+			return nil, fmt.Errorf("line %d: %s is already defined at line %d", lineNo, name, prev)
+		}
+		seen[name] = lineNo
+
+		value = strings.TrimLeft(value, " \t")
+		if value == "" || (value[0] != '"' && value[0] != '\'') {
+			if idx := strings.Index(value, " #"); idx >= 0 {
+				value = value[:idx]
+			}
+
+			out = append(out, envVar{Name: name, Value: strings.TrimSpace(value)})
+			continue
+		}
+
+		quote := value[0]
+		rest := value[1:]
+		var buf strings.Builder
+		for {
+			end, err := scanQuoted(&buf, rest, quote)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+
+			if end >= 0 {
+				tail := strings.TrimSpace(rest[end+1:])
+				if tail != "" && !strings.HasPrefix(tail, "#") {
+					return nil, fmt.Errorf("line %d: unexpected %q after closing quote", lineNo, tail)
+				}
+				break
+			}
+
+			i++
+			if i >= len(lines) {
+				return nil, fmt.Errorf("line %d: unterminated quoted value", lineNo)
+			}
+
+			buf.WriteByte('\n')
+			rest = lines[i]
+		}
+
+		out = append(out, envVar{Name: name, Value: buf.String()})
+	}
+
+	return out, nil
+}
+
+// scanQuoted appends the quoted value part to buf and returns the index of the closing quote, or -1 if
+// the value continues on the next line.
+func scanQuoted(buf *strings.Builder, s string, quote byte) (int, error) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote:
+			return i, nil
+		case c == '\\' && quote == '"':
+			if i+1 >= len(s) {
+				return 0, fmt.Errorf("dangling escape")
+			}
+
+			i++
+			switch s[i] {
+			case 'n':
+				buf.WriteByte('\n')
+			case 'r':
+				buf.WriteByte('\r')
+			case 't':
+				buf.WriteByte('\t')
+			case '"', '\\', '$':
+				buf.WriteByte(s[i])
+			default:
+				buf.WriteByte('\\')
+				buf.WriteByte(s[i])
+			}
+		default:
+			buf.WriteByte(c)
+		}
+	}
+
+	return -1, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var execArgs struct {
+	Env []string
+}
+
+var execCmd = &cobra.Command{
+	Use:           "exec --env NAME=keyID [--env ...] -- command [args...]",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "run a command with secrets in its environment",
+	Long: "Fetches secrets over one connection and replaces lupac with the command, " +
+		"so signals and the exit code belong to the command itself. Secrets are never written to disk.",
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		envKeys, err := parseEnvMapping(execArgs.Env)
+		if err != nil {
+			return err
+		}
+
+		binary, err := exec.LookPath(args[0])
+		if err != nil {
+			return fmt.Errorf("unable to find command: %w", err)
+		}
+
+		env, err := fetchEnv(envKeys)
+		if err != nil {
+			return err
+		}
+
+		if err := syscall.Exec(binary, args, env); err != nil {
+			return fmt.Errorf("unable to exec %q: %w", binary, err)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	flags := execCmd.Flags()
+	flags.StringArrayVar(&execArgs.Env, "env", nil, "environment variable to set from the secret, in NAME=keyID form")
+}
+
+type envKey struct {
+	Name  string
+	KeyID string
+}
+
+func parseEnvMapping(mapping []string) ([]envKey, error) {
+	seen := make(map[string]struct{}, len(mapping))
+	out := make([]envKey, 0, len(mapping))
+	for _, m := range mapping {
+		name, keyID, ok := strings.Cut(m, "=")
+		if !ok || keyID == "" {
+			return nil, fmt.Errorf("invalid env mapping %q: NAME=keyID expected", m)
+		}
+
+		if !envNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid env name %q", name)
+		}
+
+		if _, dup := seen[name]; dup {
+			return nil, fmt.Errorf("duplicate env name %q", name)
+		}
+		seen[name] = struct{}{}
+
+		out = append(out, envKey{
+			Name:  name,
+			KeyID: keyID,
+		})
+	}
+
+	return out, nil
+}
+
+// fetchEnv returns the current environment with secrets set, fails if any secret is unavailable.
+func fetchEnv(envKeys []envKey) ([]string, error) {
+	lupac, cleanup, err := dial()
+	if err != nil {
+		return nil, fmt.Errorf("dial failed: %w", err)
+	}
+	defer cleanup()
+
+	secrets := make(map[string]string, len(envKeys))
+	for _, k := range envKeys {
+		data, err := lupac.Get(k.KeyID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get key %q for %s: %w", k.KeyID, k.Name, err)
+		}
+
+		if bytes.IndexByte(data, 0) >= 0 {
+			return nil, fmt.Errorf("key %q for %s contains NUL byte and can't be passed in environment", k.KeyID, k.Name)
+		}
+
+		secrets[k.Name] = string(data)
+	}
+
+	out := make([]string, 0, len(os.Environ())+len(secrets))
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if _, ok := secrets[name]; ok {
+			continue
+		}
+		out = append(out, kv)
+	}
+
+	for _, k := range envKeys {
+		out = append(out, k.Name+"="+secrets[k.Name])
+	}
+
+	return out, nil
+}
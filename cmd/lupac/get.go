@@ -1,33 +1,223 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/spf13/cobra"
 )
 
+const (
+	outputText = "text"
+	outputRaw  = "raw"
+	outputJSON = "json"
+	outputEnv  = "env"
+	outputFile = "file"
+)
+
+var getArgs struct {
+	Output string
+	Base64 bool
+	Dir    string
+}
+
 var getCmd = &cobra.Command{
-	Use:           "get",
+	Use:           "get [name=]keyID...",
 	SilenceUsage:  true,
 	SilenceErrors: true,
 	Short:         "retrieve data from the server",
-	RunE: func(_ *cobra.Command, ids []string) error {
+	Long: "Retrieves secrets and prints them in the --output format:\n" +
+		"  text - \"keyID: quoted value\" lines\n" +
+		"  raw  - exact bytes of a single key\n" +
+		"  json - object of keyID to value (base64 encoded with --base64)\n" +
+		"  env  - \"export NAME='value'\" lines, NAME is derived from keyID unless given as NAME=keyID\n" +
+		"  file - writes each key to a 0600 file in --dir, named after keyID unless given as path=keyID\n" +
+		"Exits with non-zero code if any key can't be retrieved, raw, json, env and file outputs are written only if all keys are.",
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		keys, err := parseGetArgs(args)
+		if err != nil {
+			return err
+		}
+
+		switch getArgs.Output {
+		case outputText, outputJSON, outputEnv, outputFile:
+		case outputRaw:
+			if len(keys) != 1 {
+				return errors.New("raw output requires exactly one key")
+			}
+		default:
+			return fmt.Errorf("unknown output format %q", getArgs.Output)
+		}
+
 		lupac, cleanup, err := dial()
 		if err != nil {
 			return fmt.Errorf("dial failed: %w", err)
 		}
 		defer cleanup()
 
-		for _, keyID := range ids {
-			data, err := lupac.Get(keyID)
+		failed := 0
+		values := make([][]byte, len(keys))
+		for i, k := range keys {
+			data, err := lupac.Get(k.KeyID)
 			if err != nil {
-				fmt.Printf("unable to get key %q: %v\n", keyID, err)
+				failed++
+				if getArgs.Output == outputText {
+					fmt.Printf("unable to get key %q: %v\n", k.KeyID, err)
+				} else {
+					_, _ = fmt.Fprintf(os.Stderr, "unable to get key %q: %v\n", k.KeyID, err)
+				}
 				continue
 			}
 
-			fmt.Printf("%s: %q\n", keyID, string(data))
+			if getArgs.Output == outputText {
+				fmt.Printf("%s: %q\n", k.KeyID, string(data))
+			}
+			values[i] = data
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("unable to get %d of %d keys", failed, len(keys))
+		}
+
+		switch getArgs.Output {
+		case outputRaw:
+			_, err = os.Stdout.Write(values[0])
+			return err
+		case outputJSON:
+			return writeGetJSON(keys, values)
+		case outputEnv:
+			return writeGetEnv(keys, values)
+		case outputFile:
+			return writeGetFiles(keys, values)
 		}
 
 		return nil
 	},
 }
+
+func init() {
+	flags := getCmd.Flags()
+	flags.StringVarP(&getArgs.Output, "output", "o", outputText, "output format: text, raw, json, env or file")
+	flags.BoolVar(&getArgs.Base64, "base64", false, "base64 encode values in json output")
+	flags.StringVar(&getArgs.Dir, "dir", ".", "directory for file output")
+}
+
+type getKey struct {
+	Name  string
+	KeyID string
+}
+
+func parseGetArgs(args []string) ([]getKey, error) {
+	out := make([]getKey, 0, len(args))
+	for _, arg := range args {
+		// key IDs never contain "="
+		name, keyID, ok := strings.Cut(arg, "=")
+		if !ok {
+			keyID, name = name, ""
+		}
+
+		if keyID == "" {
+			return nil, fmt.Errorf("invalid key %q", arg)
+		}
+
+		out = append(out, getKey{
+			Name:  name,
+			KeyID: keyID,
+		})
+	}
+
+	return out, nil
+}
+
+func writeGetJSON(keys []getKey, values [][]byte) error {
+	out := make(map[string]string, len(keys))
+	for i, k := range keys {
+		if getArgs.Base64 {
+			out[k.KeyID] = base64.StdEncoding.EncodeToString(values[i])
+			continue
+		}
+
+		if !utf8.Valid(values[i]) {
+			return fmt.Errorf("key %q is not valid UTF-8, use --base64", k.KeyID)
+		}
+		out[k.KeyID] = string(values[i])
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+func writeGetEnv(keys []getKey, values [][]byte) error {
+	var out strings.Builder
+	for i, k := range keys {
+		name := k.Name
+		if name == "" {
+			name = envName(k.KeyID)
+		}
+
+		if !envNameRe.MatchString(name) {
+			return fmt.Errorf("invalid env name %q", name)
+		}
+
+		if strings.IndexByte(string(values[i]), 0) >= 0 {
+			return fmt.Errorf("key %q contains NUL byte and can't be passed in environment", k.KeyID)
+		}
+
+		_, _ = fmt.Fprintf(&out, "export %s=%s\n", name, shellQuote(string(values[i])))
+	}
+
+	_, err := os.Stdout.WriteString(out.String())
+	return err
+}
+
+func writeGetFiles(keys []getKey, values [][]byte) error {
+	for i, k := range keys {
+		path := k.Name
+		if path == "" {
+			path = strings.ReplaceAll(k.KeyID, "/", "_")
+		}
+
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(getArgs.Dir, path)
+		}
+
+		if err := writeFileAtomic(path, values[i], 0o600, -1, -1); err != nil {
+			return fmt.Errorf("unable to write key %q: %w", k.KeyID, err)
+		}
+
+		fmt.Printf("%s: written to %s\n", k.KeyID, path)
+	}
+
+	return nil
+}
+
+// envName derives environment variable name from the key ID: "app/db-password" -> "APP_DB_PASSWORD".
+func envName(keyID string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, keyID)
+
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultKnownHostsPath is lupa own known_hosts, so trusting lupa servers doesn't touch ~/.ssh/known_hosts.
+func defaultKnownHostsPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return filepath.Join(".lupa", "known_hosts")
+	}
+
+	return filepath.Join(dir, "lupa", "known_hosts")
+}
+
+// hostKeyCallback verifies the server host key against --fingerprint if given, or against known_hosts
+// including @cert-authority and @revoked entries. With --tofu unknown hosts are added on first contact,
+// while a changed key always fails.
+func hostKeyCallback() (ssh.HostKeyCallback, error) {
+	switch {
+	case rootArgs.Insecure && rootArgs.TOFU:
+		return nil, errors.New("--insecure and --tofu are mutually exclusive")
+	case rootArgs.Insecure && rootArgs.RemoteFingerprint != "":
+		return nil, errors.New("--insecure and --fingerprint are mutually exclusive")
+	case rootArgs.Insecure:
+		_, _ = fmt.Fprintln(os.Stderr, "warning: host key verification is disabled")
+		return ssh.InsecureIgnoreHostKey(), nil
+	case rootArgs.RemoteFingerprint != "":
+		return checkFingerprint, nil
+	}
+
+	path := rootArgs.KnownHosts
+	if path == "" {
+		path = defaultKnownHostsPath()
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := checkKnownHost(path, hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+
+		hostKey := key
+		cert, isCert := key.(*ssh.Certificate)
+		if isCert {
+			hostKey = cert.Key
+		}
+
+		fp := ssh.FingerprintSHA256(hostKey)
+		if len(keyErr.Want) > 0 {
+			known := make([]string, len(keyErr.Want))
+			for i, want := range keyErr.Want {
+				known[i] = fmt.Sprintf("%s (%s:%d)", ssh.FingerprintSHA256(want.Key), want.Filename, want.Line)
+			}
+
+			return fmt.Errorf("host key of %s has changed, possible man-in-the-middle attack: got %s, known %s",
+				hostname, fp, strings.Join(known, ", "))
+		}
+
+		if !rootArgs.TOFU {
+			unknown := "key"
+			if isCert {
+				unknown = "certificate is not signed by a known authority and its key"
+			}
+
+			return fmt.Errorf("host %s %s %s is unknown: add it to %s, check it with --fingerprint or trust it on first use with --tofu",
+				hostname, unknown, fp, path)
+		}
+
+		if err := addKnownHost(path, hostname, remote, hostKey); err != nil {
+			return err
+		}
+
+		_, _ = fmt.Fprintf(os.Stderr, "warning: permanently added %s with key %s to %s\n", hostname, fp, path)
+		return nil
+	}, nil
+}
+
+// checkKnownHost checks the key against known_hosts, a missing file knows no hosts.
+// A host certificate is checked as a plain key only if no @cert-authority is set for the host,
+// so hosts known by key keep working when they start to present certificates,
+// while an invalid certificate of a host with an authority is never trusted on first use.
+func checkKnownHost(path string, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &knownhosts.KeyError{}
+		}
+		return fmt.Errorf("unable to read known hosts: %w", err)
+	}
+
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return fmt.Errorf("invalid known hosts: %w", err)
+	}
+
+	known, err := parseKnownHosts(data)
+	if err != nil {
+		return fmt.Errorf("invalid known hosts: %w", err)
+	}
+
+	if cert, ok := key.(*ssh.Certificate); ok {
+		err = callback(hostname, remote, key)
+		var revokedErr *knownhosts.RevokedError
+		if err == nil || errors.As(err, &revokedErr) {
+			return err
+		}
+
+		if known.hasAuthority(hostname) {
+			return fmt.Errorf("invalid host certificate of %s: %w", hostname, err)
+		}
+
+		key = cert.Key
+	}
+
+	err = callback(hostname, remote, key)
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return err
+	}
+
+	// knownhosts reports @cert-authority keys as known keys of the host, they aren't
+	want := keyErr.Want[:0]
+	for _, wantKey := range keyErr.Want {
+		if !known.authorityLines[wantKey.Line] {
+			want = append(want, wantKey)
+		}
+	}
+
+	return &knownhosts.KeyError{Want: want}
+}
+
+// knownHosts keeps what knownhosts doesn't expose: which lines are @cert-authority ones and their host patterns.
+type knownHosts struct {
+	authorityLines map[int]bool
+	authorities    [][]string
+}
+
+func parseKnownHosts(data []byte) (*knownHosts, error) {
+	out := &knownHosts{
+		authorityLines: make(map[int]bool),
+	}
+
+	rest := data
+	for {
+		marker, hosts, _, _, next, err := ssh.ParseKnownHosts(rest)
+		if err == io.EOF {
+			return out, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		// the parsed line ends right before next
+		lineNo := bytes.Count(data[:len(data)-len(next)], []byte{'\n'})
+		if len(next) == 0 && !bytes.HasSuffix(data, []byte{'\n'}) {
+			lineNo++
+		}
+
+		if marker == "cert-authority" {
+			out.authorityLines[lineNo] = true
+			out.authorities = append(out.authorities, hosts)
+		}
+
+		rest = next
+	}
+}
+
+// hasAuthority reports whether any @cert-authority matches the host, whichever key it has.
+func (k *knownHosts) hasAuthority(hostname string) bool {
+	host, port, err := net.SplitHostPort(hostname)
+	if err != nil {
+		return false
+	}
+
+	for _, patterns := range k.authorities {
+		if matchHostPatterns(patterns, host, port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchHostPatterns matches host patterns of a known_hosts line the way knownhosts does:
+// a hashed host or any pattern matches while no negated one does.
+func matchHostPatterns(patterns []string, host string, port string) bool {
+	if len(patterns) == 1 && strings.HasPrefix(patterns[0], "|") {
+		return matchHashedHost(patterns[0], knownhosts.Normalize(net.JoinHostPort(host, port)))
+	}
+
+	matched := false
+	for _, pattern := range patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		patternHost, patternPort, err := net.SplitHostPort(pattern)
+		if err != nil {
+			patternHost, patternPort = pattern, "22"
+		}
+
+		if patternPort != port || !wildcardMatch(patternHost, host) {
+			continue
+		}
+
+		if negate {
+			return false
+		}
+		matched = true
+	}
+
+	return matched
+}
+
+// matchHashedHost checks a "|1|<salt>|<hash>" host, the hash is HMAC-SHA1 of the normalized address.
+func matchHashedHost(hashed string, address string) bool {
+	parts := strings.Split(hashed, "|")
+	if len(parts) != 4 || parts[1] != "1" {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(address))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// wildcardMatch supports "*" and "?", "*" matches separators too.
+func wildcardMatch(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == '*' {
+			for i := 0; i <= len(s); i++ {
+				if wildcardMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(s) == 0 || (pattern[0] != '?' && pattern[0] != s[0]) {
+			return false
+		}
+
+		pattern, s = pattern[1:], s[1:]
+	}
+
+	return len(s) == 0
+}
+
+func addKnownHost(path string, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("unable to create known hosts dir: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open known hosts: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	addresses := []string{knownhosts.Normalize(hostname)}
+	if remote != nil {
+		if remoteAddr := knownhosts.Normalize(remote.String()); remoteAddr != addresses[0] {
+			addresses = append(addresses, remoteAddr)
+		}
+	}
+
+	if _, err := fmt.Fprintln(f, knownhosts.Line(addresses, key)); err != nil {
+		return fmt.Errorf("unable to write known hosts: %w", err)
+	}
+
+	return nil
+}
+
+func checkFingerprint(_ string, _ net.Addr, key ssh.PublicKey) error {
+	actualFp := ssh.FingerprintSHA256(key)
+	if rootArgs.RemoteFingerprint == actualFp {
+		return nil
+	}
+
+	// the fingerprint of the host key is also fine when the server presents its certificate
+	if cert, ok := key.(*ssh.Certificate); ok && rootArgs.RemoteFingerprint == ssh.FingerprintSHA256(cert.Key) {
+		return nil
+	}
+
+	return fmt.Errorf("remote host key mismatch: %q (expected) != %q (actual)", rootArgs.RemoteFingerprint, actualFp)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// loadIdentity returns the signer to authenticate with and a func releasing it.
+// With --agent the key is taken from ssh-agent: the one matching the key file if it was chosen
+// explicitly or by ssh config, otherwise the agent must hold a single key.
+// The certificate of the key is used when given or found next to the key as <key>-cert.pub.
+func loadIdentity(hostCfg sshHostConfig) (ssh.Signer, func(), error) {
+	keyPath := rootArgs.PrivateKey
+	keyChosen := rootCmd.PersistentFlags().Changed("key")
+	if !keyChosen && hostCfg.IdentityFile != "" {
+		keyPath = hostCfg.IdentityFile
+		keyChosen = true
+	}
+
+	certPath := rootArgs.Cert
+	if certPath == "" {
+		certPath = hostCfg.CertificateFile
+	}
+
+	var signer ssh.Signer
+	var cleanup func()
+	var err error
+	if rootArgs.Agent {
+		var wantKey ssh.PublicKey
+		if keyChosen {
+			wantKey, err = loadPublicKey(keyPath)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		signer, cleanup, err = agentSigner(wantKey, certPath == "")
+	} else {
+		signer, cleanup, err = loadSigner(keyPath)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, isCert := signerCert(signer); isCert {
+		return signer, cleanup, nil
+	}
+
+	if certPath == "" && (keyChosen || !rootArgs.Agent) {
+		defaultPath := strings.TrimSuffix(keyPath, ".pub") + "-cert.pub"
+		if _, err := os.Stat(defaultPath); err == nil {
+			certPath = defaultPath
+		}
+	}
+
+	if certPath == "" {
+		return signer, cleanup, nil
+	}
+
+	certSigner, err := loadCertSigner(certPath, signer)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	return certSigner, cleanup, nil
+}
+
+// loadSigner reads the private key, for an encrypted one it asks ssh-agent first
+// if it holds the key and then prompts for the passphrase.
+func loadSigner(keyPath string) (ssh.Signer, func(), error) {
+	privBytes, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read private key file: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(privBytes)
+	var missingErr *ssh.PassphraseMissingError
+	switch {
+	case err == nil:
+		return signer, func() {}, nil
+	case !errors.As(err, &missingErr):
+		return nil, nil, fmt.Errorf("unable to create private key signer: %w", err)
+	}
+
+	pubKey := missingErr.PublicKey
+	if pubKey == nil {
+		// legacy PEM keys have no public part, look for it aside
+		pubKey, _ = loadPublicKey(keyPath + ".pub")
+	}
+
+	if pubKey != nil && os.Getenv("SSH_AUTH_SOCK") != "" {
+		if signer, cleanup, err := agentSigner(pubKey, false); err == nil {
+			return signer, cleanup, nil
+		}
+	}
+
+	passphrase, err := readPassphrase(fmt.Sprintf("Enter passphrase for key '%s': ", keyPath))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(privBytes, passphrase)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to decrypt private key: %w", err)
+	}
+
+	return signer, func() {}, nil
+}
+
+// loadPublicKey reads the public key of the key file: the file itself if it is a public key,
+// or the .pub file next to it, or the public part of an unencrypted private key.
+func loadPublicKey(keyPath string) (ssh.PublicKey, error) {
+	for _, p := range []string{keyPath, keyPath + ".pub"} {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+
+		if pubKey, _, _, _, err := ssh.ParseAuthorizedKey(data); err == nil {
+			return pubKey, nil
+		}
+	}
+
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key file: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	var missingErr *ssh.PassphraseMissingError
+	switch {
+	case err == nil:
+		return signer.PublicKey(), nil
+	case errors.As(err, &missingErr) && missingErr.PublicKey != nil:
+		return missingErr.PublicKey, nil
+	}
+
+	return nil, fmt.Errorf("unable to get public key of %s: %w", keyPath, err)
+}
+
+// agentSigner returns the ssh-agent signer of wantKey or, if it's nil, of the only agent key.
+// With withCert the agent certificate of the key is preferred over the plain key.
+func agentSigner(wantKey ssh.PublicKey, withCert bool) (ssh.Signer, func(), error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, nil, errors.New("ssh-agent is not available: SSH_AUTH_SOCK is not set")
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to connect to ssh-agent: %w", err)
+	}
+	cleanup := func() { _ = conn.Close() }
+
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("unable to list ssh-agent keys: %w", err)
+	}
+
+	var keys []ssh.Signer
+	for _, s := range signers {
+		if _, isCert := signerCert(s); isCert {
+			continue
+		}
+
+		if wantKey == nil || bytes.Equal(s.PublicKey().Marshal(), wantKey.Marshal()) {
+			keys = append(keys, s)
+		}
+	}
+
+	switch {
+	case len(keys) == 0 && wantKey != nil:
+		cleanup()
+		return nil, nil, fmt.Errorf("ssh-agent has no key %s", ssh.FingerprintSHA256(wantKey))
+	case len(keys) == 0:
+		cleanup()
+		return nil, nil, errors.New("ssh-agent has no keys")
+	case len(keys) > 1:
+		fps := make([]string, len(keys))
+		for i, k := range keys {
+			fps[i] = ssh.FingerprintSHA256(k.PublicKey())
+		}
+
+		cleanup()
+		return nil, nil, fmt.Errorf("ssh-agent has %d keys, choose one with --key: %s", len(keys), strings.Join(fps, ", "))
+	}
+
+	out := keys[0]
+	if withCert {
+		keyBytes := out.PublicKey().Marshal()
+		for _, s := range signers {
+			cert, isCert := signerCert(s)
+			if isCert && bytes.Equal(cert.Key.Marshal(), keyBytes) {
+				out = s
+				break
+			}
+		}
+	}
+
+	return out, cleanup, nil
+}
+
+// signerCert returns the certificate of the signer, agent keys are parsed for it.
+func signerCert(s ssh.Signer) (*ssh.Certificate, bool) {
+	pubKey, err := ssh.ParsePublicKey(s.PublicKey().Marshal())
+	if err != nil {
+		return nil, false
+	}
+
+	cert, ok := pubKey.(*ssh.Certificate)
+	return cert, ok
+}
+
+func loadCertSigner(certPath string, signer ssh.Signer) (ssh.Signer, error) {
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read certificate file: %w", err)
+	}
+
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate %s: %w", certPath, err)
+	}
+
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("invalid certificate %s: not a certificate", certPath)
+	}
+
+	out, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate %s: %w", certPath, err)
+	}
+
+	return out, nil
+}
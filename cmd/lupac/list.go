@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var listCmd = &cobra.Command{
+	Use:           "list [namespace]",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "list stored keys with their revisions, expiration and read limits",
+	Long:          "Lists own keys of the machine or, with namespace, readable keys of the shared namespace.",
+	Args:          cobra.MaximumNArgs(1),
+	RunE: func(_ *cobra.Command, args []string) error {
+		var namespace string
+		if len(args) > 0 {
+			namespace = args[0]
+		}
+
+		lupac, cleanup, err := dial()
+		if err != nil {
+			return fmt.Errorf("dial failed: %w", err)
+		}
+		defer cleanup()
+
+		keys, err := lupac.Keys(namespace)
+		if err != nil {
+			return fmt.Errorf("list keys failed: %w", err)
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(keys)
+	},
+}
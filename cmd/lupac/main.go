@@ -9,8 +9,15 @@ import (
 
 var rootArgs struct {
 	PrivateKey        string
+	Cert              string
+	Agent             bool
+	SSHConfig         string
+	User              string
 	RemoteAddr        string
 	RemoteFingerprint string
+	KnownHosts        string
+	TOFU              bool
+	Insecure          bool
 }
 
 var rootCmd = &cobra.Command{
@@ -21,13 +28,28 @@ var rootCmd = &cobra.Command{
 
 func init() {
 	flags := rootCmd.PersistentFlags()
-	flags.StringVar(&rootArgs.PrivateKey, "key", "id_rsa", "key for authentication")
-	flags.StringVar(&rootArgs.RemoteAddr, "addr", "localhost:2022", "remote addr to connect to")
-	flags.StringVar(&rootArgs.RemoteFingerprint, "fingerprint", "", "remote host fingerprint")
+	flags.StringVar(&rootArgs.PrivateKey, "key", "id_rsa", "key for authentication, with --agent may be a public key")
+	flags.StringVar(&rootArgs.Cert, "cert", "", "certificate of the key (<key>-cert.pub if exists by default)")
+	flags.BoolVar(&rootArgs.Agent, "agent", false, "authenticate with a key of ssh-agent (SSH_AUTH_SOCK)")
+	flags.StringVar(&rootArgs.SSHConfig, "ssh-config", "",
+		"OpenSSH client config (e.g. ~/.ssh/config) to take HostName, Port, IdentityFile and CertificateFile of the --addr host from")
+	flags.StringVar(&rootArgs.User, "user", "", "user to authenticate as (key fingerprint by default)")
+	flags.StringVar(&rootArgs.RemoteAddr, "addr", "localhost:2022", "remote addr to connect to, host or host:port")
+	flags.StringVar(&rootArgs.RemoteFingerprint, "fingerprint", "", "remote host fingerprint, checked instead of known hosts")
+	flags.StringVar(&rootArgs.KnownHosts, "known-hosts", "",
+		fmt.Sprintf("known hosts file to verify the remote host key with (default %s)", defaultKnownHostsPath()))
+	flags.BoolVar(&rootArgs.TOFU, "tofu", false, "trust the key of an unknown host on first use and add it to known hosts")
+	flags.BoolVar(&rootArgs.Insecure, "insecure", false, "skip remote host key verification")
 
 	rootCmd.AddCommand(
 		getCmd,
 		putCmd,
+		listCmd,
+		migrateCmd,
+		pingCmd,
+		execCmd,
+		renderCmd,
+		adminCmd,
 	)
 }
 
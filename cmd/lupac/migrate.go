@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var migrateArgs struct {
+	NewKey string
+}
+
+var migrateCmd = &cobra.Command{
+	Use:           "migrate",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "move machine secrets to a new key",
+	RunE: func(_ *cobra.Command, _ []string) error {
+		newSigner, closeSigner, err := loadSigner(migrateArgs.NewKey)
+		if err != nil {
+			return fmt.Errorf("unable to load new key: %w", err)
+		}
+		defer closeSigner()
+
+		lupac, cleanup, err := dial()
+		if err != nil {
+			return fmt.Errorf("dial failed: %w", err)
+		}
+		defer cleanup()
+
+		fromFP, toFP, err := lupac.Migrate(newSigner)
+		if err != nil {
+			return fmt.Errorf("migrate failed: %w", err)
+		}
+
+		fmt.Printf("migrated: %s -> %s\n", fromFP, toFP)
+		return nil
+	},
+}
+
+func init() {
+	flags := migrateCmd.Flags()
+	flags.StringVar(&migrateArgs.NewKey, "new-key", "", "new private key to migrate to")
+	_ = migrateCmd.MarkFlagRequired("new-key")
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var pingCmd = &cobra.Command{
+	Use:           "ping",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "check the server is able to serve requests",
+	RunE: func(_ *cobra.Command, _ []string) error {
+		start := time.Now()
+		lupac, cleanup, err := dial()
+		if err != nil {
+			return fmt.Errorf("dial failed: %w", err)
+		}
+		defer cleanup()
+		dialTime := time.Since(start)
+
+		rtt, err := lupac.Ping()
+		if err != nil {
+			return fmt.Errorf("ping failed: %w", err)
+		}
+
+		fmt.Printf("pong from %s: handshake=%s request=%s total=%s\n",
+			rootArgs.RemoteAddr, dialTime.Round(time.Microsecond), rtt.Round(time.Microsecond), time.Since(start).Round(time.Microsecond))
+		return nil
+	},
+}
@@ -1,31 +1,89 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"time"
 
 	"github.com/spf13/cobra"
+
+	"github.com/buglloc/lupa/pkg/lupa"
 )
 
+var putArgs struct {
+	Namespace   string
+	Name        string
+	File        string
+	FromEnvFile string
+	FromJSON    string
+	TTL         time.Duration
+	ExpiresAt   string
+	Once        bool
+	MaxReads    uint32
+}
+
 var putCmd = &cobra.Command{
 	Use:           "put",
 	SilenceUsage:  true,
 	SilenceErrors: true,
-	Short:         "retrieve data from the server",
-	RunE: func(_ *cobra.Command, ids []string) error {
-		data, err := io.ReadAll(os.Stdin)
+	Short:         "store data on the server",
+	Long: "Stores a single value read from stdin or --file and prints its key ID.\n" +
+		"With --from-env-file or --from-json stores all values atomically, either all or none of them, " +
+		"and prints JSON object of name to key ID. Within --namespace names are used as key names.\n" +
+		"With --ttl or --expires-at stored values expire and are removed by the server, " +
+		"with --once or --max-reads they are deleted after the last allowed read.",
+	Args: cobra.NoArgs,
+	RunE: func(_ *cobra.Command, _ []string) error {
+		if putArgs.FromEnvFile != "" || putArgs.FromJSON != "" {
+			return putMany()
+		}
+
+		var data []byte
+		var err error
+		if putArgs.File != "" {
+			data, err = os.ReadFile(putArgs.File)
+		} else {
+			data, err = io.ReadAll(os.Stdin)
+		}
 		if err != nil {
 			return fmt.Errorf("unable to read data: %w", err)
 		}
 
+		expiresAt, err := putExpiresAt()
+		if err != nil {
+			return err
+		}
+
+		maxReads, err := putMaxReads()
+		if err != nil {
+			return err
+		}
+
 		lupac, cleanup, err := dial()
 		if err != nil {
 			return fmt.Errorf("dial failed: %w", err)
 		}
 		defer cleanup()
 
-		keyID, err := lupac.Put(data)
+		var keyID string
+		switch {
+		case expiresAt != nil || putArgs.TTL != 0 || maxReads != 0:
+			keyID, err = lupac.Store(putArgs.Namespace, lupa.PutItem{
+				Name:      putArgs.Name,
+				Data:      data,
+				ExpiresAt: expiresAt,
+				TTL:       putArgs.TTL,
+				MaxReads:  maxReads,
+			})
+		case putArgs.Namespace != "":
+			keyID, err = lupac.PutShared(putArgs.Namespace, putArgs.Name, data)
+		default:
+			keyID, err = lupac.Put(data)
+		}
 		if err != nil {
 			return fmt.Errorf("put failed: %w", err)
 		}
@@ -34,3 +92,162 @@ var putCmd = &cobra.Command{
 		return nil
 	},
 }
+
+func init() {
+	flags := putCmd.Flags()
+	flags.StringVar(&putArgs.Namespace, "namespace", "", "shared namespace to store data in")
+	flags.StringVar(&putArgs.Name, "name", "", "key name in the shared namespace (random by default)")
+	flags.StringVar(&putArgs.File, "file", "", "read the value from the file instead of stdin")
+	flags.StringVar(&putArgs.FromEnvFile, "from-env-file", "", "store all variables of the .env file")
+	flags.StringVar(&putArgs.FromJSON, "from-json", "", "store all string values of the JSON object")
+	flags.DurationVar(&putArgs.TTL, "ttl", 0, "expire stored values after the duration, e.g. 24h")
+	flags.StringVar(&putArgs.ExpiresAt, "expires-at", "", "expire stored values at the time (RFC3339)")
+	flags.BoolVar(&putArgs.Once, "once", false, "delete stored values after the first read")
+	flags.Uint32Var(&putArgs.MaxReads, "max-reads", 0, "delete stored values after the number of reads")
+}
+
+func putMaxReads() (uint32, error) {
+	if !putArgs.Once {
+		return putArgs.MaxReads, nil
+	}
+
+	if putArgs.MaxReads != 0 {
+		return 0, errors.New("--once and --max-reads are mutually exclusive")
+	}
+
+	return 1, nil
+}
+
+func putExpiresAt() (*time.Time, error) {
+	if putArgs.TTL < 0 {
+		return nil, fmt.Errorf("invalid --ttl: negative duration %s", putArgs.TTL)
+	}
+
+	if putArgs.ExpiresAt == "" {
+		return nil, nil
+	}
+
+	if putArgs.TTL != 0 {
+		return nil, errors.New("--ttl and --expires-at are mutually exclusive")
+	}
+
+	out, err := time.Parse(time.RFC3339, putArgs.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --expires-at: %w", err)
+	}
+
+	return &out, nil
+}
+
+func putMany() error {
+	var items []lupa.PutItem
+	var err error
+	switch {
+	case putArgs.FromEnvFile != "" && putArgs.FromJSON != "":
+		return errors.New("--from-env-file and --from-json are mutually exclusive")
+	case putArgs.File != "" || putArgs.Name != "":
+		return errors.New("--file and --name can't be used with bulk import")
+	case putArgs.FromEnvFile != "":
+		items, err = readEnvFile(putArgs.FromEnvFile)
+	default:
+		items, err = readJSONFile(putArgs.FromJSON)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(items) == 0 {
+		return errors.New("nothing to store")
+	}
+
+	expiresAt, err := putExpiresAt()
+	if err != nil {
+		return err
+	}
+
+	maxReads, err := putMaxReads()
+	if err != nil {
+		return err
+	}
+
+	for i := range items {
+		items[i].ExpiresAt = expiresAt
+		items[i].TTL = putArgs.TTL
+		items[i].MaxReads = maxReads
+	}
+
+	lupac, cleanup, err := dial()
+	if err != nil {
+		return fmt.Errorf("dial failed: %w", err)
+	}
+	defer cleanup()
+
+	keyIDs, err := lupac.PutMany(putArgs.Namespace, items)
+	if err != nil {
+		return fmt.Errorf("put failed, nothing stored: %w", err)
+	}
+
+	out := make(map[string]string, len(items))
+	for i, item := range items {
+		out[item.Name] = keyIDs[i]
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+func readEnvFile(path string) ([]lupa.PutItem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read env file: %w", err)
+	}
+
+	vars, err := parseEnvFile(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid env file %s: %w", path, err)
+	}
+
+	out := make([]lupa.PutItem, len(vars))
+	for i, v := range vars {
+		out[i] = lupa.PutItem{
+			Name: v.Name,
+			Data: []byte(v.Value),
+		}
+	}
+
+	return out, nil
+}
+
+func readJSONFile(path string) ([]lupa.PutItem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read JSON file: %w", err)
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("invalid JSON file %s: %w", path, err)
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make([]lupa.PutItem, 0, len(values))
+	for _, name := range names {
+		value, ok := values[name].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid JSON file %s: value of %q is not a string", path, name)
+		}
+
+		out = append(out, lupa.PutItem{
+			Name: name,
+			Data: []byte(value),
+		})
+	}
+
+	return out, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var renderArgs struct {
+	Mode     string
+	Owner    string
+	Interval time.Duration
+	Reload   string
+}
+
+var renderCmd = &cobra.Command{
+	Use:           "render <template> <output>",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "render a text/template file with secrets",
+	Long: "Renders Go text/template with {{ lupa \"keyID\" }} and {{ lupa \"keyID\" | base64 }} functions " +
+		"and atomically replaces the output file when the result changes.\n" +
+		"With --interval keeps re-rendering and runs the --reload command after each change.",
+	Args: cobra.ExactArgs(2),
+	RunE: func(_ *cobra.Command, args []string) error {
+		mode, err := strconv.ParseUint(renderArgs.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid mode %q: %w", renderArgs.Mode, err)
+		}
+
+		uid, gid, err := parseOwner(renderArgs.Owner)
+		if err != nil {
+			return err
+		}
+
+		r := &renderer{
+			tmplPath: args[0],
+			outPath:  args[1],
+			mode:     fs.FileMode(mode),
+			uid:      uid,
+			gid:      gid,
+			reload:   renderArgs.Reload,
+		}
+
+		if renderArgs.Interval <= 0 {
+			return r.Render()
+		}
+
+		stopChan := make(chan os.Signal, 1)
+		signal.Notify(stopChan, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(stopChan)
+
+		ticker := time.NewTicker(renderArgs.Interval)
+		defer ticker.Stop()
+
+		for {
+			if err := r.Render(); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "%s: %v\n", time.Now().Format(time.RFC3339), err)
+			}
+
+			select {
+			case <-stopChan:
+				return nil
+			case <-ticker.C:
+			}
+		}
+	},
+}
+
+func init() {
+	flags := renderCmd.Flags()
+	flags.StringVar(&renderArgs.Mode, "mode", "0600", "output file mode")
+	flags.StringVar(&renderArgs.Owner, "owner", "", "output file owner in user[:group] form, names or IDs")
+	flags.DurationVar(&renderArgs.Interval, "interval", 0, "re-render with the interval instead of exiting")
+	flags.StringVar(&renderArgs.Reload, "reload", "", "shell command to run after the output is changed")
+}
+
+type renderer struct {
+	tmplPath string
+	outPath  string
+	mode     fs.FileMode
+	uid      int
+	gid      int
+	reload   string
+	// reloadPending is set while the reload command has not succeeded for the current output
+	reloadPending bool
+}
+
+// Render renders the template and, if the result differs from the output file, replaces it
+// and runs the reload command. A failed reload is retried on the next render even if nothing changed.
+func (r *renderer) Render() error {
+	tmpl, err := os.ReadFile(r.tmplPath)
+	if err != nil {
+		return fmt.Errorf("unable to read template: %w", err)
+	}
+
+	lupac, cleanup, err := dial()
+	if err != nil {
+		return fmt.Errorf("dial failed: %w", err)
+	}
+
+	out, err := lupac.Render(filepath.Base(r.tmplPath), string(tmpl))
+	cleanup()
+	if err != nil {
+		return err
+	}
+
+	current, err := os.ReadFile(r.outPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("unable to read output file: %w", err)
+	}
+
+	if err != nil || !bytes.Equal(current, out) {
+		if err := writeFileAtomic(r.outPath, out, r.mode, r.uid, r.gid); err != nil {
+			return err
+		}
+
+		r.reloadPending = r.reload != ""
+	}
+
+	if !r.reloadPending {
+		return nil
+	}
+
+	cmd := exec.Command("sh", "-c", r.reload)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("reload command failed: %w", err)
+	}
+
+	r.reloadPending = false
+	return nil
+}
+
+// parseOwner parses user[:group] into uid and gid, -1 means unchanged.
+func parseOwner(owner string) (int, int, error) {
+	if owner == "" {
+		return -1, -1, nil
+	}
+
+	userName, groupName, _ := strings.Cut(owner, ":")
+	uid, gid := -1, -1
+	if userName != "" {
+		id, err := strconv.Atoi(userName)
+		if err != nil {
+			u, err := user.Lookup(userName)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid owner: %w", err)
+			}
+
+			id, _ = strconv.Atoi(u.Uid)
+		}
+		uid = id
+	}
+
+	if groupName != "" {
+		id, err := strconv.Atoi(groupName)
+		if err != nil {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid owner group: %w", err)
+			}
+
+			id, _ = strconv.Atoi(g.Gid)
+		}
+		gid = id
+	}
+
+	return uid, gid, nil
+}
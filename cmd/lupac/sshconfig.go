@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// sshHostConfig is the part of OpenSSH client config used for lupa connections.
+type sshHostConfig struct {
+	HostName        string
+	Port            string
+	IdentityFile    string
+	CertificateFile string
+}
+
+// loadSSHConfig returns settings of the host from the OpenSSH client config, like ssh(1) does
+// the first obtained value of each setting wins. Match and Include directives are not supported,
+// Match blocks are skipped.
+func loadSSHConfig(cfgPath string, host string) (sshHostConfig, error) {
+	var out sshHostConfig
+	f, err := os.Open(expandHome(cfgPath))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return out, nil
+		}
+		return out, fmt.Errorf("unable to open ssh config: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	host = strings.ToLower(host)
+	active := true
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		keyword, args, err := splitSSHConfigLine(scanner.Text())
+		if err != nil {
+			return out, fmt.Errorf("invalid ssh config %s: line %d: %w", cfgPath, lineNo, err)
+		}
+
+		switch keyword {
+		case "":
+			continue
+		case "host":
+			active = matchSSHHost(host, args)
+			continue
+		case "match":
+			active = false
+			continue
+		}
+
+		if !active || len(args) == 0 {
+			continue
+		}
+
+		setOnce := func(dst *string, v string) {
+			if *dst == "" {
+				*dst = v
+			}
+		}
+
+		switch keyword {
+		case "hostname":
+			setOnce(&out.HostName, strings.ReplaceAll(args[0], "%h", host))
+		case "port":
+			setOnce(&out.Port, args[0])
+		case "identityfile":
+			setOnce(&out.IdentityFile, expandSSHPath(args[0], host))
+		case "certificatefile":
+			setOnce(&out.CertificateFile, expandSSHPath(args[0], host))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return out, fmt.Errorf("unable to read ssh config: %w", err)
+	}
+
+	return out, nil
+}
+
+// splitSSHConfigLine returns the lowercase keyword and arguments of the config line,
+// the keyword may be separated by "=" and arguments may be double quoted.
+func splitSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+
+	var args []string
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			return keyword, args, nil
+		}
+
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, errors.New("unterminated quote")
+			}
+
+			args = append(args, rest[1:end+1])
+			rest = rest[end+2:]
+			continue
+		}
+
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+
+		args = append(args, rest[:end])
+		rest = rest[end:]
+	}
+}
+
+// matchSSHHost reports whether the host matches any of the Host patterns and none of the negated ones.
+func matchSSHHost(host string, patterns []string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.ToLower(strings.TrimPrefix(pattern, "!"))
+		if ok, _ := path.Match(pattern, host); !ok {
+			continue
+		}
+
+		if negated {
+			return false
+		}
+		matched = true
+	}
+
+	return matched
+}
+
+// expandSSHPath expands "~" and %d (home), %h (host) and %% tokens of the config path.
+func expandSSHPath(p string, host string) string {
+	home, _ := os.UserHomeDir()
+	p = strings.NewReplacer("%d", home, "%h", host, "%%", "%").Replace(p)
+	return expandHome(p)
+}
+
+func expandHome(p string) string {
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+
+	return filepath.Join(home, p[1:])
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+
+	"golang.org/x/term"
+)
+
+// readPassphrase asks for a passphrase on the controlling terminal with echo disabled,
+// so it works with redirected stdin and stdout.
+func readPassphrase(prompt string) ([]byte, error) {
+	in, out, err := openTerminal()
+	if err != nil {
+		return nil, fmt.Errorf("no terminal to ask passphrase: %w", err)
+	}
+	defer func() {
+		_ = in.Close()
+		_ = out.Close()
+	}()
+
+	fd := int(in.Fd())
+	state, err := term.GetState(fd)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get terminal state: %w", err)
+	}
+
+	// Ctrl+C still interrupts the prompt, echo must be back before exiting
+	sigChan := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigChan, os.Interrupt)
+	defer func() {
+		signal.Stop(sigChan)
+		close(done)
+	}()
+	go func() {
+		select {
+		case <-sigChan:
+			_ = term.Restore(fd, state)
+			_, _ = fmt.Fprintln(out)
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+
+	if _, err := fmt.Fprint(out, prompt); err != nil {
+		return nil, err
+	}
+
+	passphrase, err := term.ReadPassword(fd)
+	_, _ = fmt.Fprintln(out)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read passphrase: %w", err)
+	}
+
+	return passphrase, nil
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// openTerminal opens the Windows console, elsewhere it fails and the passphrase can't be asked.
+func openTerminal() (*os.File, *os.File, error) {
+	in, err := os.OpenFile("CONIN$", os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0)
+	if err != nil {
+		_ = in.Close()
+		return nil, nil, err
+	}
+
+	return in, out, nil
+}
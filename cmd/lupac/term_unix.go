@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import "os"
+
+func openTerminal() (*os.File, *os.File, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		_ = tty.Close()
+		return nil, nil, err
+	}
+
+	return tty, out, nil
+}
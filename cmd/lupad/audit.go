@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/buglloc/lupa/internal/audit"
+)
+
+var auditCmd = &cobra.Command{
+	Use:           "audit",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "Audit log tools",
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:           "verify [file...]",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "Verifies audit log hash chain, configured log with rotated files by default",
+	RunE: func(_ *cobra.Command, files []string) error {
+		var headPath string
+		if len(files) == 0 {
+			if cfg.Audit.Path == "" {
+				return errors.New("audit log is not configured")
+			}
+
+			var err error
+			files, err = audit.Files(cfg.Audit.Path)
+			if err != nil {
+				return fmt.Errorf("unable to list audit logs: %w", err)
+			}
+			headPath = cfg.Audit.Path
+		}
+
+		res, err := audit.Verify(files, headPath)
+		if err != nil {
+			return fmt.Errorf("audit log verification failed: %w", err)
+		}
+
+		fmt.Printf("audit log is intact: %d records (seq %d..%d) in %d files\n", res.Records, res.FirstSeq, res.LastSeq, len(files))
+		return nil
+	},
+}
+
+func init() {
+	auditCmd.AddCommand(
+		auditVerifyCmd,
+	)
+}
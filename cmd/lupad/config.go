@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+
+	"github.com/buglloc/lupa/internal/lupad"
+)
+
+var configCmd = &cobra.Command{
+	Use:           "config",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "Config tools",
+}
+
+var configCheckCmd = &cobra.Command{
+	Use:           "check",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "Validates config files",
+	RunE: func(_ *cobra.Command, _ []string) error {
+		warnings, err := lupad.CheckConfig(cfg)
+		for _, warning := range warnings {
+			_, _ = fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+		}
+
+		var cfgErr *lupad.ConfigError
+		if errors.As(err, &cfgErr) {
+			for _, problem := range cfgErr.Problems {
+				_, _ = fmt.Fprintf(os.Stderr, "error: %s\n", problem)
+			}
+			return fmt.Errorf("config is invalid: %d errors", len(cfgErr.Problems))
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("config is valid")
+		return nil
+	},
+}
+
+var configDumpCmd = &cobra.Command{
+	Use:           "dump",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "Prints effective config merged from all config files and defaults",
+	RunE: func(_ *cobra.Command, _ []string) error {
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(cfg); err != nil {
+			return fmt.Errorf("unable to encode config: %w", err)
+		}
+
+		return enc.Close()
+	},
+}
+
+func init() {
+	configCmd.AddCommand(
+		configCheckCmd,
+		configDumpCmd,
+	)
+}
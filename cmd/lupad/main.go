@@ -33,13 +33,7 @@ func init() {
 				os.Exit(1)
 			}
 		},
-		func() {
-			if cfg.Debug {
-				zerolog.SetGlobalLevel(zerolog.DebugLevel)
-			} else {
-				zerolog.SetGlobalLevel(zerolog.InfoLevel)
-			}
-		},
+		setLogLevel,
 	)
 
 	flags := rootCmd.PersistentFlags()
@@ -47,9 +41,19 @@ func init() {
 
 	rootCmd.AddCommand(
 		startCmd,
+		auditCmd,
+		configCmd,
 	)
 }
 
+func setLogLevel() {
+	if cfg.Debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+}
+
 func main() {
 	_, _ = maxprocs.Set(maxprocs.Logger(log.Info().Msgf))
 
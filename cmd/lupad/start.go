@@ -11,6 +11,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 
+	"github.com/buglloc/lupa/internal/config"
 	"github.com/buglloc/lupa/internal/lupad"
 )
 
@@ -37,24 +38,49 @@ var startCmd = &cobra.Command{
 			}
 		}()
 
+		reloadChan := make(chan os.Signal, 1)
+		signal.Notify(reloadChan, syscall.SIGHUP)
 		stopChan := make(chan os.Signal, 1)
 		signal.Notify(stopChan, syscall.SIGINT, syscall.SIGTERM)
-		select {
-		case <-stopChan:
-			log.Info().Msg("shutting down gracefully by signal")
+		for {
+			select {
+			case <-reloadChan:
+				reloadConfig(lupaSrv)
+				continue
+			case <-stopChan:
+				log.Info().Msg("shutting down gracefully by signal")
 
-			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
-			defer cancel()
+				ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+				defer cancel()
 
-			if err := lupaSrv.Shutdown(ctx); err != nil {
-				log.Error().Err(err).Msg("shutdown failed")
+				if err := lupaSrv.Shutdown(ctx); err != nil {
+					log.Error().Err(err).Msg("shutdown failed")
+				}
+			case err := <-errChan:
+				log.Error().Err(err).Msg("start failed")
+				return err
+			case <-doneChan:
 			}
-		case err := <-errChan:
-			log.Error().Err(err).Msg("start failed")
-			return err
-		case <-doneChan:
-		}
 
-		return nil
+			return nil
+		}
 	},
 }
+
+func reloadConfig(lupaSrv *lupad.Server) {
+	log.Info().Strs("configs", configs).Msg("reloading config by signal")
+
+	newCfg, err := config.LoadConfig(configs...)
+	if err != nil {
+		log.Error().Err(err).Msg("unable to load config, keep the current one")
+		return
+	}
+
+	if err := lupaSrv.Reload(newCfg); err != nil {
+		log.Error().Err(err).Msg("unable to apply config, keep the current one")
+		return
+	}
+
+	cfg = newCfg
+	setLogLevel()
+}
@@ -0,0 +1,389 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OutcomeOK    = "ok"
+	OutcomeError = "error"
+)
+
+const rotatedTimeLayout = "20060102T150405.000000000"
+
+// Record is a single audit log entry. Each record is chained to the previous one with
+// PrevHash, and Hash covers the whole record including PrevHash.
+type Record struct {
+	Seq        uint64            `json:"seq"`
+	Time       time.Time         `json:"time"`
+	SessionID  string            `json:"session_id,omitempty"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	User       string            `json:"user,omitempty"`
+	MachineFP  string            `json:"machine_fp,omitempty"`
+	Role       string            `json:"role,omitempty"`
+	Type       string            `json:"type"`
+	KeyID      string            `json:"key_id,omitempty"`
+	Outcome    string            `json:"outcome"`
+	Error      string            `json:"error,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+	PrevHash   string            `json:"prev_hash"`
+	Hash       string            `json:"hash"`
+}
+
+type head struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+type Config struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+}
+
+// Logger appends hash chained records to a JSON lines file with size based rotation.
+type Logger struct {
+	mu    sync.Mutex
+	cfg   Config
+	f     *os.File
+	size  int64
+	head  head
+	index seqIndex
+}
+
+func Open(cfg Config) (*Logger, error) {
+	l := &Logger{
+		cfg: cfg,
+		index: seqIndex{
+			files: make(map[string]*fileIndex),
+		},
+	}
+
+	var err error
+	l.head, err = loadHead(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.openLocked(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Log completes the record with sequence number, time and hashes, then appends it.
+func (l *Logger) Log(rec Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return errors.New("audit log is closed")
+	}
+
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	rec.Time = rec.Time.UTC()
+	rec.Seq = l.head.Seq + 1
+	rec.PrevHash = l.head.Hash
+
+	var err error
+	rec.Hash, err = recordHash(rec)
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("unable to marshal audit record: %w", err)
+	}
+	line = append(line, '\n')
+
+	if l.cfg.MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.cfg.MaxSize {
+		if err := l.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("unable to write audit record: %w", err)
+	}
+
+	l.head = head{
+		Seq:  rec.Seq,
+		Hash: rec.Hash,
+	}
+	return saveHead(l.cfg.Path, l.head)
+}
+
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+func (l *Logger) openLocked() error {
+	f, err := os.OpenFile(l.cfg.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open audit log: %w", err)
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("unable to stat audit log: %w", err)
+	}
+
+	l.f = f
+	l.size = stat.Size()
+	return nil
+}
+
+func (l *Logger) rotateLocked() error {
+	if err := l.f.Close(); err != nil {
+		return fmt.Errorf("unable to close audit log: %w", err)
+	}
+	l.f = nil
+
+	rotatedPath := fmt.Sprintf("%s.%s", l.cfg.Path, time.Now().UTC().Format(rotatedTimeLayout))
+	if err := os.Rename(l.cfg.Path, rotatedPath); err != nil {
+		return fmt.Errorf("unable to rotate audit log: %w", err)
+	}
+	l.index.rename(l.cfg.Path, rotatedPath)
+
+	if l.cfg.MaxBackups > 0 {
+		rotated, err := rotatedFiles(l.cfg.Path)
+		if err != nil {
+			return err
+		}
+
+		for len(rotated) > l.cfg.MaxBackups {
+			if err := os.Remove(rotated[0]); err != nil {
+				return fmt.Errorf("unable to remove old audit log: %w", err)
+			}
+			l.index.remove(rotated[0])
+			rotated = rotated[1:]
+		}
+	}
+
+	return l.openLocked()
+}
+
+// Files returns rotated audit log files from the oldest to the newest followed by the current one.
+func Files(path string) ([]string, error) {
+	out, err := rotatedFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		out = append(out, path)
+	}
+	return out, nil
+}
+
+// Scan calls fn for each record of the files in order, stops when fn returns false.
+func Scan(files []string, fn func(file string, rec Record) (bool, error)) error {
+	for _, file := range files {
+		stop, err := scanFile(file, fn)
+		if err != nil {
+			return err
+		}
+
+		if stop {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+type VerifyResult struct {
+	Records  int
+	FirstSeq uint64
+	LastSeq  uint64
+	LastHash string
+}
+
+// Verify checks the hash chain of the files and, when path is set, compares its end
+// with the recorded head to detect truncation.
+func Verify(files []string, path string) (VerifyResult, error) {
+	var out VerifyResult
+	var prev *Record
+	err := Scan(files, func(file string, rec Record) (bool, error) {
+		expectedHash, err := recordHash(rec)
+		if err != nil {
+			return false, err
+		}
+
+		if rec.Hash != expectedHash {
+			return false, fmt.Errorf("%s: record %d was modified: hash mismatch", file, rec.Seq)
+		}
+
+		switch {
+		case prev == nil:
+			if rec.Seq == 1 && rec.PrevHash != "" {
+				return false, fmt.Errorf("%s: record 1 is not the chain start", file)
+			}
+			out.FirstSeq = rec.Seq
+		case rec.Seq != prev.Seq+1:
+			return false, fmt.Errorf("%s: records %d..%d are missing", file, prev.Seq+1, rec.Seq-1)
+		case rec.PrevHash != prev.Hash:
+			return false, fmt.Errorf("%s: record %d is not chained to record %d", file, rec.Seq, prev.Seq)
+		}
+
+		prev = &rec
+		out.Records++
+		out.LastSeq = rec.Seq
+		out.LastHash = rec.Hash
+		return false, nil
+	})
+	if err != nil {
+		return out, err
+	}
+
+	if path == "" {
+		return out, nil
+	}
+
+	h, err := loadHead(path)
+	if err != nil {
+		return out, err
+	}
+
+	if h.Seq != out.LastSeq || h.Hash != out.LastHash {
+		return out, fmt.Errorf("log ends at record %d, but record %d was written: log was truncated", out.LastSeq, h.Seq)
+	}
+
+	return out, nil
+}
+
+func scanFile(file string, fn func(file string, rec Record) (bool, error)) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, fmt.Errorf("unable to open audit log: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return false, fmt.Errorf("%s:%d: invalid audit record: %w", file, lineNo, err)
+		}
+
+		stop, err := fn(file, rec)
+		if err != nil || stop {
+			return stop, err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("%s: unable to read audit log: %w", file, err)
+	}
+	return false, nil
+}
+
+func recordHash(rec Record) (string, error) {
+	rec.Hash = ""
+	rec.Time = rec.Time.UTC()
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal audit record: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func rotatedFiles(path string) ([]string, error) {
+	files, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read audit log dir: %w", err)
+	}
+
+	prefix := filepath.Base(path) + "."
+	var out []string
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		if _, err := time.Parse(rotatedTimeLayout, strings.TrimPrefix(name, prefix)); err != nil {
+			continue
+		}
+
+		out = append(out, filepath.Join(filepath.Dir(path), name))
+	}
+
+	// rotation suffix is a fixed width timestamp
+	sort.Strings(out)
+	return out, nil
+}
+
+func headPath(path string) string {
+	return path + ".head"
+}
+
+func loadHead(path string) (head, error) {
+	var out head
+	rawHead, err := os.ReadFile(headPath(path))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return out, nil
+		}
+		return out, fmt.Errorf("unable to read audit log head: %w", err)
+	}
+
+	if err := json.Unmarshal(rawHead, &out); err != nil {
+		return out, fmt.Errorf("invalid audit log head: %w", err)
+	}
+	return out, nil
+}
+
+func saveHead(path string, h head) error {
+	rawHead, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("unable to marshal audit log head: %w", err)
+	}
+
+	tmpPath := headPath(path) + ".tmp"
+	if err := os.WriteFile(tmpPath, rawHead, 0600); err != nil {
+		return fmt.Errorf("unable to write audit log head: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, headPath(path)); err != nil {
+		return fmt.Errorf("unable to replace audit log head: %w", err)
+	}
+	return nil
+}
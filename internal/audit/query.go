@@ -0,0 +1,263 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Filter selects audit records, zero fields match everything.
+type Filter struct {
+	MachineFP string
+	KeyID     string
+	Type      string
+	Outcome   string
+	Since     time.Time
+	Until     time.Time
+}
+
+func (f *Filter) Match(rec *Record) bool {
+	switch {
+	case f.MachineFP != "" && rec.MachineFP != f.MachineFP:
+		return false
+	case f.KeyID != "" && rec.KeyID != f.KeyID:
+		return false
+	case f.Type != "" && rec.Type != f.Type:
+		return false
+	case f.Outcome != "" && rec.Outcome != f.Outcome:
+		return false
+	case !f.Since.IsZero() && rec.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !rec.Time.Before(f.Until):
+		return false
+	}
+
+	return true
+}
+
+// indexEvery is the distance in records between offsets kept by seqIndex.
+const indexEvery = 256
+
+type seqOffset struct {
+	Seq    uint64
+	Offset int64
+}
+
+type fileIndex struct {
+	// marks are offsets of every indexEvery record sorted by Seq
+	marks []seqOffset
+	// lastSeq is the last record of a rotated file once it was read till the end
+	lastSeq  uint64
+	complete bool
+}
+
+// seqIndex keeps sparse record offsets of audit log files learned by queries,
+// so a page is read from near its cursor instead of the beginning of the log.
+type seqIndex struct {
+	mu    sync.Mutex
+	files map[string]*fileIndex
+}
+
+// offset returns the offset to read records after cursor from, and false if the file
+// has no such records at all.
+func (x *seqIndex) offset(file string, cursor uint64) (int64, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	idx, ok := x.files[file]
+	if !ok {
+		return 0, true
+	}
+
+	if idx.complete && idx.lastSeq <= cursor {
+		return 0, false
+	}
+
+	i := sort.Search(len(idx.marks), func(i int) bool {
+		return idx.marks[i].Seq > cursor+1
+	})
+	if i == 0 {
+		return 0, true
+	}
+
+	return idx.marks[i-1].Offset, true
+}
+
+func (x *seqIndex) mark(file string, seq uint64, offset int64) {
+	if seq%indexEvery != 0 {
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	idx := x.fileLocked(file)
+	i := sort.Search(len(idx.marks), func(i int) bool {
+		return idx.marks[i].Seq >= seq
+	})
+	if i < len(idx.marks) && idx.marks[i].Seq == seq {
+		return
+	}
+
+	idx.marks = append(idx.marks, seqOffset{})
+	copy(idx.marks[i+1:], idx.marks[i:])
+	idx.marks[i] = seqOffset{Seq: seq, Offset: offset}
+}
+
+func (x *seqIndex) complete(file string, lastSeq uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	idx := x.fileLocked(file)
+	idx.lastSeq = lastSeq
+	idx.complete = true
+}
+
+// rename moves offsets of the rotated current file, they stay valid.
+func (x *seqIndex) rename(from string, to string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if idx, ok := x.files[from]; ok {
+		x.files[to] = idx
+		delete(x.files, from)
+	}
+}
+
+func (x *seqIndex) remove(file string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	delete(x.files, file)
+}
+
+func (x *seqIndex) fileLocked(file string) *fileIndex {
+	idx, ok := x.files[file]
+	if !ok {
+		idx = &fileIndex{}
+		x.files[file] = idx
+	}
+	return idx
+}
+
+// Query returns up to limit records matching the filter with sequence numbers greater than cursor,
+// and the cursor of the next page or zero when there are no more records.
+// fits is consulted before adding each record, so the caller can cap the page size.
+func (l *Logger) Query(filter Filter, cursor uint64, limit int, fits func(rec *Record) bool) ([]Record, uint64, error) {
+	l.mu.Lock()
+	currentSize := l.size
+	l.mu.Unlock()
+
+	files, err := rotatedFiles(l.cfg.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var out []Record
+	var next uint64
+	scanFn := func(rec *Record) bool {
+		if rec.Seq <= cursor || !filter.Match(rec) {
+			return true
+		}
+
+		if len(out) > 0 && (len(out) >= limit || (fits != nil && !fits(rec))) {
+			next = out[len(out)-1].Seq
+			return false
+		}
+
+		out = append(out, *rec)
+		return true
+	}
+
+	for _, file := range files {
+		// rotated files are named by the rotation time, so they can't contain newer records
+		rotatedAt, err := time.Parse(rotatedTimeLayout, strings.TrimPrefix(filepath.Base(file), filepath.Base(l.cfg.Path)+"."))
+		if err == nil && !filter.Since.IsZero() && rotatedAt.Before(filter.Since) {
+			continue
+		}
+
+		more, err := l.queryFile(file, cursor, -1, scanFn)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if !more {
+			return out, next, nil
+		}
+	}
+
+	// current file is read only up to its size at the query start, there may be a record being written after it
+	if _, err := l.queryFile(l.cfg.Path, cursor, currentSize, scanFn); err != nil {
+		return nil, 0, err
+	}
+
+	return out, next, nil
+}
+
+// queryFile reads records of the file starting near the cursor and up to size unless it's negative,
+// offsets of the records read are added to the index.
+func (l *Logger) queryFile(file string, cursor uint64, size int64, fn func(rec *Record) bool) (bool, error) {
+	offset, ok := l.index.offset(file, cursor)
+	if !ok {
+		return true, nil
+	}
+
+	if size >= 0 && offset > size {
+		// the file was rotated and replaced since the index was built
+		offset = 0
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return false, fmt.Errorf("unable to open audit log: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return false, fmt.Errorf("unable to seek audit log: %w", err)
+	}
+
+	var r io.Reader = f
+	if size >= 0 {
+		r = io.LimitReader(f, size-offset)
+	}
+
+	var lastSeq uint64
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		lineOffset := offset
+		offset += int64(len(line)) + 1
+		if len(line) == 0 {
+			continue
+		}
+
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return false, fmt.Errorf("%s: invalid audit record: %w", file, err)
+		}
+
+		l.index.mark(file, rec.Seq, lineOffset)
+		lastSeq = rec.Seq
+		if !fn(&rec) {
+			return false, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("%s: unable to read audit log: %w", file, err)
+	}
+
+	if size < 0 && lastSeq > 0 {
+		l.index.complete(file, lastSeq)
+	}
+	return true, nil
+}
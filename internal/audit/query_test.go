@@ -0,0 +1,83 @@
+package audit
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueryPages(t *testing.T) {
+	l, err := Open(Config{
+		Path:    filepath.Join(t.TempDir(), "audit.log"),
+		MaxSize: 64 << 10,
+	})
+	if err != nil {
+		t.Fatalf("unable to open audit log: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+
+	const records = 3 * indexEvery * 2
+	for i := 0; i < records; i++ {
+		outcome := OutcomeOK
+		if i%3 == 0 {
+			outcome = OutcomeError
+		}
+
+		if err := l.Log(Record{Type: "get", KeyID: fmt.Sprintf("key-%d", i), Outcome: outcome}); err != nil {
+			t.Fatalf("unable to log record %d: %v", i, err)
+		}
+	}
+
+	files, err := Files(l.cfg.Path)
+	if err != nil {
+		t.Fatalf("unable to list audit log files: %v", err)
+	}
+
+	if len(files) < 2 {
+		t.Fatalf("log was not rotated: %v", files)
+	}
+
+	for _, filter := range []Filter{{}, {Outcome: OutcomeError}} {
+		var want []uint64
+		for seq := uint64(1); seq <= records; seq++ {
+			if filter.Outcome == "" || (seq-1)%3 == 0 {
+				want = append(want, seq)
+			}
+		}
+
+		// the second pass reads through the index built by the first one
+		for pass := 0; pass < 2; pass++ {
+			var got []uint64
+			var cursor uint64
+			for {
+				page, next, err := l.Query(filter, cursor, 100, nil)
+				if err != nil {
+					t.Fatalf("query failed: %v", err)
+				}
+
+				for _, rec := range page {
+					got = append(got, rec.Seq)
+				}
+
+				if next == 0 {
+					break
+				}
+				cursor = next
+			}
+
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("filter %+v pass %d: got %d records, want %d", filter, pass, len(got), len(want))
+			}
+		}
+	}
+
+	for _, file := range files[:len(files)-1] {
+		if offset, ok := l.index.offset(file, records); ok {
+			t.Fatalf("rotated file %s is not skipped by the index, offset %d", file, offset)
+		}
+	}
+
+	if offset, _ := l.index.offset(l.cfg.Path, records-1); offset == 0 && len(l.index.files[l.cfg.Path].marks) > 0 {
+		t.Fatal("current file is read from the beginning despite known offsets")
+	}
+}
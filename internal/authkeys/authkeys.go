@@ -0,0 +1,404 @@
+package authkeys
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/buglloc/lupa/internal/netacl"
+)
+
+// RoleEnv is the environment option carrying the lupa role of a key, e.g. environment="LUPA_ROLE=admin".
+// OpenSSH accepts and ignores it unless PermitUserEnvironment is set, so the same file can be used for sshd.
+const RoleEnv = "LUPA_ROLE"
+
+const sourceAddressOption = "source-address"
+
+// Key is a single authorized_keys entry.
+type Key struct {
+	// Fingerprint of the key, or of the CA key for cert-authority entries.
+	Fingerprint   string
+	CertAuthority bool
+	Principals    []string
+	Role          string
+	From          []netip.Prefix
+	NotFrom       []netip.Prefix
+	ExpiresAt     time.Time
+	Source        string
+}
+
+// File is a set of keys loaded from an authorized_keys file or from all files of a directory.
+// Reload drops all keys when reading fails, so a removed or unreadable file authorizes nobody.
+type File struct {
+	mu       sync.RWMutex
+	path     string
+	sig      string
+	keys     []Key
+	problems []string
+}
+
+func Open(path string) (*File, error) {
+	f := &File{
+		path: path,
+	}
+
+	if _, err := f.Reload(); err != nil {
+		return f, err
+	}
+
+	return f, nil
+}
+
+func (f *File) Path() string {
+	return f.path
+}
+
+// Keys returns loaded entries.
+func (f *File) Keys() []Key {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.keys
+}
+
+// Problems returns entries skipped on the last load, in "file:line: reason" form.
+func (f *File) Problems() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.problems
+}
+
+// Authorize returns the entry authorizing the key for the user connecting from remoteAddr.
+// Plain keys match by fingerprint, certificates match cert-authority entries of their signing CA
+// and must list the user (or one of the entry principals) as a principal.
+func (f *File) Authorize(user string, pubKey ssh.PublicKey, remoteAddr net.Addr, now time.Time) (Key, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	cert, isCert := pubKey.(*ssh.Certificate)
+	fp := ssh.FingerprintSHA256(pubKey)
+	if isCert {
+		fp = ssh.FingerprintSHA256(cert.SignatureKey)
+	}
+
+	var lastErr error
+	for _, key := range f.keys {
+		if key.CertAuthority != isCert || key.Fingerprint != fp {
+			continue
+		}
+
+		if err := key.check(user, cert, remoteAddr, now); err != nil {
+			lastErr = err
+			continue
+		}
+
+		return key, nil
+	}
+
+	if lastErr != nil {
+		return Key{}, lastErr
+	}
+	return Key{}, fmt.Errorf("key %s is not authorized", ssh.FingerprintSHA256(pubKey))
+}
+
+// Reload re-reads the file or directory if it was changed since the last load.
+func (f *File) Reload() (bool, error) {
+	files, sig, err := f.stat()
+	if err != nil {
+		f.reset()
+		return false, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if sig == f.sig {
+		return false, nil
+	}
+
+	var keys []Key
+	var problems []string
+	for _, file := range files {
+		fileKeys, fileProblems, err := parseFile(file)
+		if err != nil {
+			f.keys, f.problems, f.sig = nil, nil, ""
+			return false, err
+		}
+
+		keys = append(keys, fileKeys...)
+		problems = append(problems, fileProblems...)
+	}
+
+	f.keys = keys
+	f.problems = problems
+	f.sig = sig
+	return true, nil
+}
+
+// reset fails closed, the next successful load brings keys back.
+func (f *File) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.keys, f.problems, f.sig = nil, nil, ""
+}
+
+// stat returns files to load and their signature, which changes when any of them is modified.
+func (f *File) stat() ([]string, string, error) {
+	stat, err := os.Stat(f.path)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to stat authorized keys: %w", err)
+	}
+
+	files := []string{f.path}
+	if stat.IsDir() {
+		entries, err := os.ReadDir(f.path)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to read authorized keys dir: %w", err)
+		}
+
+		files = files[:0]
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			files = append(files, filepath.Join(f.path, entry.Name()))
+		}
+		sort.Strings(files)
+	}
+
+	var sig strings.Builder
+	existing := files[:0]
+	for _, file := range files {
+		fileStat, err := os.Stat(file)
+		if err != nil {
+			// a file removed from the dir after listing is just not loaded
+			if stat.IsDir() && errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, "", fmt.Errorf("unable to stat authorized keys: %w", err)
+		}
+
+		existing = append(existing, file)
+		_, _ = fmt.Fprintf(&sig, "%s:%d:%d\n", file, fileStat.ModTime().UnixNano(), fileStat.Size())
+	}
+
+	return existing, sig.String(), nil
+}
+
+func (k *Key) check(user string, cert *ssh.Certificate, remoteAddr net.Addr, now time.Time) error {
+	if !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt) {
+		return fmt.Errorf("key %s expired at %s", k.Fingerprint, k.ExpiresAt.Format(time.RFC3339))
+	}
+
+	if len(k.From) > 0 || len(k.NotFrom) > 0 {
+		addr, err := netacl.RemoteAddr(remoteAddr)
+		if err != nil {
+			return err
+		}
+
+		if netacl.Contains(k.NotFrom, addr) || !netacl.Contains(k.From, addr) {
+			return fmt.Errorf("source address %s is not allowed for key %s", addr, k.Fingerprint)
+		}
+	}
+
+	if cert == nil {
+		return nil
+	}
+
+	if cert.CertType != ssh.UserCert {
+		return fmt.Errorf("certificate %d signed by %s is not a user certificate", cert.Serial, k.Fingerprint)
+	}
+
+	principals := k.Principals
+	if len(principals) == 0 {
+		principals = []string{user}
+	}
+
+	checker := ssh.CertChecker{
+		Clock:                    func() time.Time { return now },
+		SupportedCriticalOptions: []string{sourceAddressOption},
+	}
+	for _, principal := range principals {
+		if err := checker.CheckCert(principal, cert); err == nil {
+			return checkSourceAddress(cert, remoteAddr)
+		}
+	}
+
+	return fmt.Errorf("certificate %d signed by %s has no allowed principals", cert.Serial, k.Fingerprint)
+}
+
+// checkSourceAddress enforces the source-address critical option, a list of addresses and CIDRs.
+func checkSourceAddress(cert *ssh.Certificate, remoteAddr net.Addr) error {
+	value, ok := cert.CriticalOptions[sourceAddressOption]
+	if !ok {
+		return nil
+	}
+
+	allowed, err := netacl.ParsePrefixes(strings.Split(value, ","))
+	if err != nil {
+		return fmt.Errorf("certificate %d has invalid source-address: %w", cert.Serial, err)
+	}
+
+	addr, err := netacl.RemoteAddr(remoteAddr)
+	if err != nil {
+		return err
+	}
+
+	if !netacl.Contains(allowed, addr) {
+		return fmt.Errorf("source address %s is not allowed for certificate %d", addr, cert.Serial)
+	}
+
+	return nil
+}
+
+func parseFile(path string) ([]Key, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read authorized keys: %w", err)
+	}
+
+	var keys []Key
+	var problems []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		source := fmt.Sprintf("%s:%d", path, lineNo)
+		key, err := parseLine(line)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", source, err))
+			continue
+		}
+
+		key.Source = source
+		keys = append(keys, key)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("unable to read authorized keys: %w", err)
+	}
+
+	return keys, problems, nil
+}
+
+func parseLine(line []byte) (Key, error) {
+	pubKey, _, options, _, err := ssh.ParseAuthorizedKey(line)
+	if err != nil {
+		return Key{}, err
+	}
+
+	out := Key{
+		Fingerprint: ssh.FingerprintSHA256(pubKey),
+	}
+
+	for _, opt := range options {
+		name, value, hasValue := strings.Cut(opt, "=")
+		if hasValue {
+			value = unquote(value)
+		}
+
+		switch strings.ToLower(name) {
+		case "cert-authority":
+			out.CertAuthority = true
+		case "principals":
+			out.Principals = strings.Split(value, ",")
+		case "from":
+			out.From, out.NotFrom, err = parseFrom(value)
+			if err != nil {
+				return Key{}, fmt.Errorf("invalid from option: %w", err)
+			}
+		case "expiry-time":
+			out.ExpiresAt, err = parseExpiryTime(value)
+			if err != nil {
+				return Key{}, fmt.Errorf("invalid expiry-time option: %w", err)
+			}
+		case "environment":
+			envName, envValue, _ := strings.Cut(value, "=")
+			if envName == RoleEnv {
+				out.Role = envValue
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// parseFrom parses OpenSSH from= pattern list, only addresses and CIDRs are supported.
+// A key with unsupported patterns is skipped rather than allowed from anywhere.
+func parseFrom(value string) ([]netip.Prefix, []netip.Prefix, error) {
+	var allowed, denied []string
+	for _, pattern := range strings.Split(value, ",") {
+		if strings.HasPrefix(pattern, "!") {
+			denied = append(denied, strings.TrimPrefix(pattern, "!"))
+			continue
+		}
+		allowed = append(allowed, pattern)
+	}
+
+	if len(allowed) == 0 {
+		return nil, nil, errors.New("no allowed sources")
+	}
+
+	allowedPrefixes, err := netacl.ParsePrefixes(allowed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deniedPrefixes, err := netacl.ParsePrefixes(denied)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return allowedPrefixes, deniedPrefixes, nil
+}
+
+// parseExpiryTime parses OpenSSH YYYYMMDD[HHMM[SS]] time, in local time zone unless suffixed with Z.
+func parseExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") {
+		loc = time.UTC
+		value = strings.TrimSuffix(value, "Z")
+	}
+
+	var layout string
+	switch len(value) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("unexpected format %q", value)
+	}
+
+	return time.ParseInLocation(layout, value, loc)
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+
+	return strings.ReplaceAll(value, `\"`, `"`)
+}
@@ -0,0 +1,133 @@
+package authkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("unable to create signer: %v", err)
+	}
+
+	return signer
+}
+
+func TestAuthorizeCertificate(t *testing.T) {
+	ca := newTestSigner(t)
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	line := "cert-authority " + string(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+	if err := os.WriteFile(path, []byte(line), 0600); err != nil {
+		t.Fatalf("unable to write authorized keys: %v", err)
+	}
+
+	keys, err := Open(path)
+	if err != nil {
+		t.Fatalf("unable to open authorized keys: %v", err)
+	}
+
+	now := time.Now()
+	remoteAddr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2022}
+	cases := []struct {
+		name     string
+		certType uint32
+		options  map[string]string
+		allowed  bool
+	}{
+		{
+			name:     "user",
+			certType: ssh.UserCert,
+			allowed:  true,
+		},
+		{
+			name:     "host",
+			certType: ssh.HostCert,
+		},
+		{
+			name:     "allowed source address",
+			certType: ssh.UserCert,
+			options:  map[string]string{"source-address": "198.51.100.1,192.0.2.0/24"},
+			allowed:  true,
+		},
+		{
+			name:     "other source address",
+			certType: ssh.UserCert,
+			options:  map[string]string{"source-address": "198.51.100.0/24"},
+		},
+		{
+			name:     "unsupported critical option",
+			certType: ssh.UserCert,
+			options:  map[string]string{"force-command": "true"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cert := &ssh.Certificate{
+				Key:             newTestSigner(t).PublicKey(),
+				CertType:        tc.certType,
+				ValidPrincipals: []string{"alice"},
+				ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+				ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+				Permissions:     ssh.Permissions{CriticalOptions: tc.options},
+			}
+			if err := cert.SignCert(rand.Reader, ca); err != nil {
+				t.Fatalf("unable to sign certificate: %v", err)
+			}
+
+			_, err := keys.Authorize("alice", cert, remoteAddr, now)
+			if tc.allowed && err != nil {
+				t.Fatalf("certificate is not authorized: %v", err)
+			}
+
+			if !tc.allowed && err == nil {
+				t.Fatal("certificate is authorized")
+			}
+		})
+	}
+}
+
+func TestReloadFailsClosed(t *testing.T) {
+	signer := newTestSigner(t)
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := os.WriteFile(path, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600); err != nil {
+		t.Fatalf("unable to write authorized keys: %v", err)
+	}
+
+	keys, err := Open(path)
+	if err != nil {
+		t.Fatalf("unable to open authorized keys: %v", err)
+	}
+
+	now := time.Now()
+	if _, err := keys.Authorize("alice", signer.PublicKey(), nil, now); err != nil {
+		t.Fatalf("key is not authorized: %v", err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("unable to remove authorized keys: %v", err)
+	}
+
+	if _, err := keys.Reload(); err == nil {
+		t.Fatal("reload of a missing file succeeded")
+	}
+
+	if _, err := keys.Authorize("alice", signer.PublicKey(), nil, now); err == nil {
+		t.Fatal("key is authorized after its file was removed")
+	}
+}
@@ -1,34 +1,98 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+type RateLimit struct {
+	HandshakesPerIP   int           `yaml:"handshakes_per_ip"`
+	HandshakesGlobal  int           `yaml:"handshakes_global"`
+	AuthFailuresPerIP int           `yaml:"auth_failures_per_ip"`
+	FailureWindow     time.Duration `yaml:"failure_window"`
+	BanDuration       time.Duration `yaml:"ban_duration"`
+}
+
+// Limits bound connections. IdleTimeout closes a connection without requests in flight for that long,
+// it is tracked per connection rather than per channel as channels of a connection are served one at a time.
+type Limits struct {
+	MaxConnections      int           `yaml:"max_connections"`
+	MaxConnectionsPerIP int           `yaml:"max_connections_per_ip"`
+	HandshakeTimeout    time.Duration `yaml:"handshake_timeout"`
+	IdleTimeout         time.Duration `yaml:"idle_timeout"`
+	MaxLifetime         time.Duration `yaml:"max_lifetime"`
+}
+
 type SSH struct {
-	Addr     string   `yaml:"addr"`
-	HostKeys []string `yaml:"host_keys"`
+	Addr           string    `yaml:"addr"`
+	HostKeys       []string  `yaml:"host_keys"`
+	TrustedUserCAs []string  `yaml:"trusted_user_cas"`
+	MaxAuthTries   int       `yaml:"max_auth_tries"`
+	RateLimit      RateLimit `yaml:"rate_limit"`
+	Limits         Limits    `yaml:"limits"`
 }
 
 type User struct {
-	Role       string   `yaml:"role"`
-	SHA256Keys []string `yaml:"sha256_keys"`
+	Role           string   `yaml:"role"`
+	SHA256Keys     []string `yaml:"sha256_keys"`
+	AuthorizedKeys string   `yaml:"authorized_keys"`
+	From           []string `yaml:"from"`
+}
+
+type AuthorizedKeys struct {
+	CheckInterval time.Duration `yaml:"check_interval"`
 }
 
 type DB struct {
-	StorePath string `yaml:"store_path"`
+	StorePath     string        `yaml:"store_path"`
+	SweepInterval time.Duration `yaml:"sweep_interval"`
+}
+
+type Revocations struct {
+	Path          string        `yaml:"path"`
+	CheckInterval time.Duration `yaml:"check_interval"`
+}
+
+type SourceRestrictions struct {
+	DefaultAllow []string `yaml:"default_allow"`
+	Pin          string   `yaml:"pin"`
+	PinEnforce   bool     `yaml:"pin_enforce"`
+}
+
+type HTTP struct {
+	Addr string `yaml:"addr"`
+}
+
+type Audit struct {
+	Path       string `yaml:"path"`
+	MaxSizeMB  int64  `yaml:"max_size_mb"`
+	MaxBackups int    `yaml:"max_backups"`
 }
 
 type Config struct {
-	Debug             bool            `yaml:"debug"`
-	SSH               SSH             `yaml:"ssh"`
-	DB                DB              `yaml:"db"`
-	AllowRegistration bool            `yaml:"allow_registration"`
-	Users             map[string]User `yaml:"users"`
+	Debug              bool               `yaml:"debug"`
+	SSH                SSH                `yaml:"ssh"`
+	DB                 DB                 `yaml:"db"`
+	HTTP               HTTP               `yaml:"http"`
+	Audit              Audit              `yaml:"audit"`
+	Revocations        Revocations        `yaml:"revocations"`
+	SourceRestrictions SourceRestrictions `yaml:"source_restrictions"`
+	AuthorizedKeys     AuthorizedKeys     `yaml:"authorized_keys"`
+	AllowRegistration  bool               `yaml:"allow_registration"`
+	Users              map[string]User    `yaml:"users"`
+	// UnknownEnv lists LUPAD_* environment variables matching no config field
+	UnknownEnv []string `yaml:"-"`
 }
 
+// LoadConfig builds the config with the following precedence, later wins:
+//   - defaults;
+//   - config files in the given order, a file overrides only the fields it sets;
+//   - LUPAD_* environment variables (see EnvPrefix), a variable replaces the whole field.
 func LoadConfig(configs ...string) (*Config, error) {
 	out := &Config{
 		Debug: true,
@@ -39,14 +103,35 @@ func LoadConfig(configs ...string) (*Config, error) {
 				"ssh_host_ecdsa_key",
 				"ssh_host_ed25519_key",
 			},
+			MaxAuthTries: 6,
+			RateLimit: RateLimit{
+				HandshakesPerIP:   60,
+				HandshakesGlobal:  600,
+				AuthFailuresPerIP: 20,
+				FailureWindow:     10 * time.Minute,
+				BanDuration:       15 * time.Minute,
+			},
+			Limits: Limits{
+				MaxConnections:      1024,
+				MaxConnectionsPerIP: 32,
+				HandshakeTimeout:    10 * time.Second,
+				IdleTimeout:         5 * time.Minute,
+				MaxLifetime:         time.Hour,
+			},
 		},
 		DB: DB{
-			StorePath: "./db",
+			StorePath:     "./db",
+			SweepInterval: time.Minute,
+		},
+		Revocations: Revocations{
+			CheckInterval: 10 * time.Second,
+		},
+		Audit: Audit{
+			MaxSizeMB: 100,
+		},
+		AuthorizedKeys: AuthorizedKeys{
+			CheckInterval: 10 * time.Second,
 		},
-	}
-
-	if len(configs) == 0 {
-		return out, nil
 	}
 
 	for _, cfgPath := range configs {
@@ -57,7 +142,9 @@ func LoadConfig(configs ...string) (*Config, error) {
 			}
 			defer func() { _ = f.Close() }()
 
-			if err := yaml.NewDecoder(f).Decode(&out); err != nil {
+			dec := yaml.NewDecoder(f)
+			dec.KnownFields(true)
+			if err := dec.Decode(&out); err != nil && !errors.Is(err, io.EOF) {
 				return fmt.Errorf("invalid config: %w", err)
 			}
 
@@ -68,5 +155,11 @@ func LoadConfig(configs ...string) (*Config, error) {
 		}
 	}
 
+	var err error
+	out.UnknownEnv, err = applyEnv(out, os.Environ())
+	if err != nil {
+		return nil, fmt.Errorf("unable to load config from environment: %w", err)
+	}
+
 	return out, nil
 }
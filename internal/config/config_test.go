@@ -0,0 +1,179 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, name string, data string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("unable to write %s: %v", name, err)
+	}
+
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	base := writeTestFile(t, "base.yaml", `
+ssh:
+  addr: "127.0.0.1:2022"
+  max_auth_tries: 3
+db:
+  store_path: "/var/lib/lupa"
+`)
+	override := writeTestFile(t, "override.yaml", `
+ssh:
+  max_auth_tries: 4
+`)
+	storePath := writeTestFile(t, "store_path", "/srv/lupa\n")
+
+	cases := []struct {
+		name    string
+		configs []string
+		env     map[string]string
+		check   func(t *testing.T, cfg *Config)
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.SSH.Addr != ":2022" || cfg.SSH.MaxAuthTries != 6 || cfg.DB.StorePath != "./db" {
+					t.Fatalf("unexpected defaults: addr %q, max_auth_tries %d, store_path %q",
+						cfg.SSH.Addr, cfg.SSH.MaxAuthTries, cfg.DB.StorePath)
+				}
+			},
+		},
+		{
+			name:    "file over defaults",
+			configs: []string{base},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.SSH.Addr != "127.0.0.1:2022" || cfg.SSH.MaxAuthTries != 3 {
+					t.Fatalf("file fields are not applied: addr %q, max_auth_tries %d", cfg.SSH.Addr, cfg.SSH.MaxAuthTries)
+				}
+
+				if cfg.SSH.RateLimit.BanDuration != 15*time.Minute {
+					t.Fatalf("default of a field missing in the file is lost: %s", cfg.SSH.RateLimit.BanDuration)
+				}
+			},
+		},
+		{
+			name:    "later file over earlier",
+			configs: []string{base, override},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.SSH.MaxAuthTries != 4 || cfg.SSH.Addr != "127.0.0.1:2022" {
+					t.Fatalf("unexpected merge: addr %q, max_auth_tries %d", cfg.SSH.Addr, cfg.SSH.MaxAuthTries)
+				}
+			},
+		},
+		{
+			name:    "env over file",
+			configs: []string{base},
+			env: map[string]string{
+				"LUPAD_SSH_ADDR":                    ":3022",
+				"LUPAD_SSH_RATE_LIMIT_BAN_DURATION": "1h",
+				"LUPAD_SSH_HOST_KEYS":               "a_key, b_key",
+			},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.SSH.Addr != ":3022" {
+					t.Fatalf("env is not applied: addr %q", cfg.SSH.Addr)
+				}
+
+				if cfg.SSH.RateLimit.BanDuration != time.Hour {
+					t.Fatalf("env duration is not applied: %s", cfg.SSH.RateLimit.BanDuration)
+				}
+
+				if !reflect.DeepEqual(cfg.SSH.HostKeys, []string{"a_key", "b_key"}) {
+					t.Fatalf("env list is not applied: %v", cfg.SSH.HostKeys)
+				}
+
+				if cfg.SSH.MaxAuthTries != 3 {
+					t.Fatalf("file field not set by env is lost: %d", cfg.SSH.MaxAuthTries)
+				}
+			},
+		},
+		{
+			name:    "env file over file",
+			configs: []string{base},
+			env: map[string]string{
+				"LUPAD_DB_STORE_PATH_FILE": storePath,
+			},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.DB.StorePath != "/srv/lupa" {
+					t.Fatalf("_FILE env is not applied: store_path %q", cfg.DB.StorePath)
+				}
+			},
+		},
+		{
+			name: "unknown env",
+			env: map[string]string{
+				"LUPAD_VERSION": "1.2.3",
+			},
+			check: func(t *testing.T, cfg *Config) {
+				if !reflect.DeepEqual(cfg.UnknownEnv, []string{"LUPAD_VERSION"}) {
+					t.Fatalf("unknown env is not reported: %v", cfg.UnknownEnv)
+				}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for name, value := range tc.env {
+				t.Setenv(name, value)
+			}
+
+			cfg, err := LoadConfig(tc.configs...)
+			if err != nil {
+				t.Fatalf("unable to load config: %v", err)
+			}
+
+			tc.check(t, cfg)
+		})
+	}
+}
+
+func TestLoadConfigEnvErrors(t *testing.T) {
+	storePath := writeTestFile(t, "store_path", "/srv/lupa")
+
+	cases := []struct {
+		name string
+		env  map[string]string
+	}{
+		{
+			name: "both value and file",
+			env: map[string]string{
+				"LUPAD_DB_STORE_PATH":      "/var/lib/lupa",
+				"LUPAD_DB_STORE_PATH_FILE": storePath,
+			},
+		},
+		{
+			name: "missing file",
+			env: map[string]string{
+				"LUPAD_DB_STORE_PATH_FILE": filepath.Join(t.TempDir(), "missing"),
+			},
+		},
+		{
+			name: "invalid value",
+			env: map[string]string{
+				"LUPAD_SSH_MAX_AUTH_TRIES": "many",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for name, value := range tc.env {
+				t.Setenv(name, value)
+			}
+
+			if _, err := LoadConfig(); err == nil {
+				t.Fatal("LoadConfig succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of environment variables overriding config fields,
+// e.g. LUPAD_SSH_ADDR overrides ssh.addr and LUPAD_SSH_RATE_LIMIT_BAN_DURATION overrides ssh.rate_limit.ban_duration.
+// Every variable has a _FILE variant that reads the value from a file, e.g. LUPAD_SSH_ADDR_FILE.
+const EnvPrefix = "LUPAD_"
+
+const envFileSuffix = "_FILE"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyEnv sets config fields from the environment and returns variables with the prefix matching no field,
+// they aren't fatal as the prefix may be shared with unrelated deployment settings.
+func applyEnv(cfg *Config, environ []string) ([]string, error) {
+	fields := make(map[string]reflect.Value)
+	envFields(EnvPrefix, reflect.ValueOf(cfg).Elem(), fields)
+
+	vars := make(map[string]string)
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, EnvPrefix) {
+			vars[name] = value
+		}
+	}
+
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var unknown []string
+	for _, name := range names {
+		value := vars[name]
+		field, ok := fields[name]
+		if !ok {
+			fieldName := strings.TrimSuffix(name, envFileSuffix)
+			field, ok = fields[fieldName]
+			if !ok || fieldName == name {
+				unknown = append(unknown, name)
+				continue
+			}
+
+			if _, dup := vars[fieldName]; dup {
+				return nil, fmt.Errorf("both %s and %s are set", fieldName, name)
+			}
+
+			data, err := os.ReadFile(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: unable to read file: %w", name, err)
+			}
+			value = strings.TrimRight(string(data), "\r\n")
+		}
+
+		if err := setEnvField(field, value); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+
+	return unknown, nil
+}
+
+func envFields(prefix string, v reflect.Value, out map[string]reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		name := prefix + strings.ToUpper(tag)
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct && field.Type() != durationType {
+			envFields(name+"_", field, out)
+			continue
+		}
+
+		out[name] = field
+	}
+}
+
+func setEnvField(field reflect.Value, value string) error {
+	switch {
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+		return nil
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "["):
+		items := make([]string, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+		return nil
+	}
+
+	// everything else is a YAML value: numbers, booleans, durations, lists and maps in the flow style
+	out := reflect.New(field.Type())
+	dec := yaml.NewDecoder(bytes.NewReader([]byte(value)))
+	dec.KnownFields(true)
+	if err := dec.Decode(out.Interface()); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	field.Set(out.Elem())
+	return nil
+}
@@ -0,0 +1,274 @@
+package lupad
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/buglloc/lupa/internal/audit"
+	"github.com/buglloc/lupa/internal/mdb"
+	"github.com/buglloc/lupa/internal/sshd"
+	"github.com/buglloc/lupa/pkg/lupa"
+)
+
+func newAuditLogger(cfg *audit.Config) (*audit.Logger, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+
+	return audit.Open(*cfg)
+}
+
+func (s *Server) auditRequest(conn *ssh.ServerConn, typ string, req interface{}, rsp interface{}, reqErr error) {
+	rec := audit.Record{
+		SessionID:  hex.EncodeToString(conn.SessionID()),
+		RemoteAddr: conn.RemoteAddr().String(),
+		User:       conn.User(),
+		Type:       typ,
+		Outcome:    audit.OutcomeOK,
+	}
+
+	if conn.Permissions != nil {
+		rec.MachineFP = conn.Permissions.Extensions[sshd.ExtensionPubFp]
+		rec.Role = conn.Permissions.Extensions[sshd.ExtensionRole]
+	}
+
+	if reqErr != nil {
+		rec.Outcome = audit.OutcomeError
+		rec.Error = reqErr.Error()
+	}
+
+	rec.KeyID, rec.Details = auditRequestDetails(req, rsp)
+	s.audit(rec)
+}
+
+// onKeyExpired logs keys removed by the sweeper, they have no request to be audited with.
+func (s *Server) onKeyExpired(key mdb.ExpiredKey) {
+	keyID := key.KeyID
+	if key.Namespace != "" {
+		keyID = lupa.SharedKeyID(key.Namespace, key.KeyID)
+	}
+
+	log.Info().
+		Str("machine_fp", key.MachineFP).
+		Str("key_id", keyID).
+		Time("expires_at", key.ExpiresAt).
+		Msg("expired key removed")
+
+	s.audit(audit.Record{
+		MachineFP: key.MachineFP,
+		Type:      "expire",
+		KeyID:     keyID,
+		Outcome:   audit.OutcomeOK,
+		Details: map[string]string{
+			"expires_at": key.ExpiresAt.UTC().Format(time.RFC3339),
+		},
+	})
+}
+
+func (s *Server) audit(rec audit.Record) {
+	if s.auditLog == nil {
+		return
+	}
+
+	if err := s.auditLog.Log(rec); err != nil {
+		log.Error().Err(err).Str("type", rec.Type).Msg("unable to write audit record")
+	}
+}
+
+func auditRequestDetails(req interface{}, rsp interface{}) (string, map[string]string) {
+	switch r := req.(type) {
+	case *lupa.GetReqMsg:
+		return r.KeyID, nil
+	case *lupa.PutReqMsg:
+		if putRsp, ok := rsp.(*lupa.PutRspMsg); ok {
+			return putRsp.KeyID, nil
+		}
+	case *lupa.CASReqMsg:
+		details := map[string]string{
+			"expected_rev": fmt.Sprint(r.Rev),
+		}
+
+		if casRsp, ok := rsp.(*lupa.CASRspMsg); ok {
+			details["rev"] = fmt.Sprint(casRsp.Rev)
+		}
+		return r.KeyID, details
+	case *lupa.PutSharedReqMsg:
+		if putRsp, ok := rsp.(*lupa.PutRspMsg); ok {
+			return putRsp.KeyID, nil
+		}
+		return lupa.SharedKeyID(r.Namespace, r.KeyID), nil
+	case *lupa.PutManyReqMsg:
+		details := map[string]string{
+			"namespace": r.Namespace,
+		}
+
+		if putRsp, ok := rsp.(*lupa.PutManyRspMsg); ok {
+			var keyIDs []string
+			if err := json.Unmarshal(putRsp.Data, &keyIDs); err == nil {
+				details["key_ids"] = strings.Join(keyIDs, ",")
+			}
+		}
+		return "", details
+	case *lupa.BatchReqMsg:
+		details := map[string]string{
+			"namespace": r.Namespace,
+		}
+
+		var ops []lupa.BatchOp
+		if err := json.Unmarshal(r.Data, &ops); err == nil {
+			kinds := make([]string, len(ops))
+			for i, op := range ops {
+				kinds[i] = op.Op
+			}
+			details["ops"] = strings.Join(kinds, ",")
+		}
+
+		if batchRsp, ok := rsp.(*lupa.BatchRspMsg); ok {
+			var res lupa.BatchRsp
+			if err := json.Unmarshal(batchRsp.Data, &res); err == nil {
+				keyIDs := make([]string, len(res.Results))
+				for i, r := range res.Results {
+					keyIDs[i] = r.KeyID
+				}
+				details["key_ids"] = strings.Join(keyIDs, ",")
+				details["applied"] = fmt.Sprint(res.Applied)
+			}
+		}
+		return "", details
+	case *lupa.MigrateReqMsg:
+		if migrateRsp, ok := rsp.(*lupa.MigrateRspMsg); ok {
+			return "", map[string]string{
+				"from_fp": migrateRsp.FromFP,
+				"to_fp":   migrateRsp.ToFP,
+			}
+		}
+	case *lupa.AdminMigrateReqMsg:
+		return "", map[string]string{
+			"from_fp": r.FromFP,
+			"to_fp":   r.ToFP,
+		}
+	case *lupa.RevokeReqMsg:
+		return "", map[string]string{
+			"kind":  r.Kind,
+			"value": r.Value,
+		}
+	case *lupa.SetPolicyReqMsg:
+		return "", map[string]string{
+			"name":      r.Name,
+			"namespace": r.Namespace,
+		}
+	case *lupa.DeletePolicyReqMsg:
+		return "", map[string]string{
+			"name": r.Name,
+		}
+	case *lupa.SetLabelsReqMsg:
+		return "", map[string]string{
+			"machine_fp": r.MachineFP,
+		}
+	case *lupa.SetSourcesReqMsg:
+		return "", map[string]string{
+			"machine_fp": r.MachineFP,
+		}
+	case *lupa.UnpinSourceReqMsg:
+		return "", map[string]string{
+			"machine_fp": r.MachineFP,
+		}
+	case *lupa.UnbanReqMsg:
+		return "", map[string]string{
+			"addr": r.Addr,
+		}
+	}
+
+	return "", nil
+}
+
+const (
+	defaultAuditPageLimit = 100
+	maxAuditPageLimit     = 1000
+	// keep the page well below the channel message limit
+	maxAuditPageBytes = 48 << 10
+)
+
+type SSHToAudit struct {
+	log *audit.Logger
+}
+
+func BindAuditHandlers(auditLog *audit.Logger, sshSrv *sshd.Server) *SSHToAudit {
+	out := &SSHToAudit{
+		log: auditLog,
+	}
+
+	sshSrv.AddHandler("admin-audit", out.Query)
+	return out
+}
+
+func (s *SSHToAudit) Query(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	if _, err := sshConRequireAdmin(conn); err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.AuditQueryReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	if s.log == nil {
+		return nil, errors.New("audit log is disabled")
+	}
+
+	filter := audit.Filter{
+		MachineFP: req.MachineFP,
+		KeyID:     req.KeyID,
+		Type:      req.Type,
+		Outcome:   req.Outcome,
+	}
+	if req.Since != 0 {
+		filter.Since = time.Unix(0, int64(req.Since))
+	}
+	if req.Until != 0 {
+		filter.Until = time.Unix(0, int64(req.Until))
+	}
+
+	limit := int(req.Limit)
+	switch {
+	case limit == 0:
+		limit = defaultAuditPageLimit
+	case limit > maxAuditPageLimit:
+		limit = maxAuditPageLimit
+	}
+
+	pageBytes := 0
+	records, next, err := s.log.Query(filter, req.Cursor, limit, func(rec *audit.Record) bool {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return false
+		}
+
+		pageBytes += len(data) + 1
+		return pageBytes <= maxAuditPageBytes
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to query audit log: %w", err)
+	}
+
+	if records == nil {
+		records = make([]audit.Record, 0)
+	}
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal audit records: %w", err)
+	}
+
+	return &lupa.AuditQueryRspMsg{
+		Data:       data,
+		NextCursor: next,
+	}, nil
+}
@@ -0,0 +1,82 @@
+package lupad
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/buglloc/lupa/internal/sshd"
+	"github.com/buglloc/lupa/pkg/lupa"
+)
+
+type SSHToBans struct {
+	sshd *sshd.Server
+}
+
+func BindBanHandlers(sshSrv *sshd.Server) *SSHToBans {
+	out := &SSHToBans{
+		sshd: sshSrv,
+	}
+
+	sshSrv.AddHandler("admin-bans", out.List)
+	sshSrv.AddHandler("admin-unban", out.Unban)
+	return out
+}
+
+func (s *SSHToBans) List(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	if _, err := sshConRequireAdmin(conn); err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.ListBansReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	out := make([]lupa.Ban, 0)
+	for _, ban := range s.sshd.Bans() {
+		if req.Addr != "" && req.Addr != ban.Addr {
+			continue
+		}
+
+		out = append(out, lupa.Ban{
+			Addr:     ban.Addr,
+			Until:    ban.Until,
+			Failures: ban.Failures,
+		})
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal bans: %w", err)
+	}
+
+	return &lupa.BansRspMsg{
+		Data: data,
+	}, nil
+}
+
+func (s *SSHToBans) Unban(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	actorFP, err := sshConRequireAdmin(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.UnbanReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	if !s.sshd.Unban(req.Addr) {
+		return nil, fmt.Errorf("address %q is not banned", req.Addr)
+	}
+
+	log.Info().
+		Str("source_addr", req.Addr).
+		Str("actor", actorFP).
+		Msg("source unbanned")
+
+	return &lupa.SuccessMsg{}, nil
+}
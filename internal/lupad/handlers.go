@@ -1,50 +1,123 @@
 package lupad
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/gofrs/uuid"
+	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/ssh"
 
 	"github.com/buglloc/lupa/internal/mdb"
+	"github.com/buglloc/lupa/internal/netacl"
+	"github.com/buglloc/lupa/internal/policy"
 	"github.com/buglloc/lupa/internal/sshd"
 	"github.com/buglloc/lupa/pkg/lupa"
 )
 
+var sharedKeyRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_./-]*$`)
+
+const (
+	maxBatchOps = 256
+	// keep the response well below the channel message limit
+	maxBatchRspBytes = 60 << 10
+	maxKeysPageBytes = 48 << 10
+	// keeps any single key well within a keys page
+	maxKeyIDLen = 256
+)
+
 type SSHToMDB struct {
-	mdb *mdb.MachineDB
+	mdb      *mdb.MachineDB
+	policies *policy.Store
+	sources  *netacl.Store
 }
 
-func BindHandlers(mdb *mdb.MachineDB, sshSrv *sshd.Server) *SSHToMDB {
+func BindHandlers(mdb *mdb.MachineDB, policies *policy.Store, sources *netacl.Store, sshSrv *sshd.Server) *SSHToMDB {
 	out := &SSHToMDB{
-		mdb: mdb,
+		mdb:      mdb,
+		policies: policies,
+		sources:  sources,
 	}
 
+	sshSrv.AddHandler("ping", out.Ping)
 	sshSrv.AddHandler("get", out.Get)
+	sshSrv.AddHandler("get-rev", out.GetRev)
+	sshSrv.AddHandler("cas", out.CompareAndSwap)
 	sshSrv.AddHandler("put", out.Put)
+	sshSrv.AddHandler("put-shared", out.PutShared)
+	sshSrv.AddHandler("put-many", out.PutMany)
+	sshSrv.AddHandler("batch", out.Batch)
+	sshSrv.AddHandler("keys", out.Keys)
+	sshSrv.AddHandler("migrate", out.Migrate)
+	sshSrv.AddHandler("admin-migrate", out.AdminMigrate)
 	return out
 }
 
+func (s *SSHToMDB) Ping(_ *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	req, ok := msg.(*lupa.PingReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	return &lupa.PingRspMsg{
+		Nonce: req.Nonce,
+	}, nil
+}
+
 func (s *SSHToMDB) Get(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
-	machineFP, err := sshConToMachineFP(conn)
+	entry, err := s.getEntry(conn, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lupa.GetRspMsg{
+		Data: entry.Data,
+	}, nil
+}
+
+func (s *SSHToMDB) GetRev(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	entry, err := s.getEntry(conn, msg)
 	if err != nil {
 		return nil, err
 	}
 
+	return &lupa.GetRevRspMsg{
+		Data: entry.Data,
+		Rev:  entry.Rev,
+	}, nil
+}
+
+func (s *SSHToMDB) getEntry(conn *ssh.ServerConn, msg interface{}) (mdb.Entry, error) {
+	machineFP, err := sshConToMachineFP(conn)
+	if err != nil {
+		return mdb.Entry{}, err
+	}
+
 	req, ok := msg.(*lupa.GetReqMsg)
 	if !ok {
-		return nil, fmt.Errorf("unexpected request type: %T", req)
+		return mdb.Entry{}, fmt.Errorf("unexpected request type: %T", req)
 	}
 
-	out, err := s.mdb.Get(machineFP, req.KeyID)
+	var out mdb.Entry
+	if namespace, keyID, ok := lupa.SplitSharedKeyID(req.KeyID); ok {
+		subj := sshConToPolicySubject(conn, machineFP)
+		if !s.policies.Allowed(subj, namespace, keyID, policy.AccessRead) {
+			return mdb.Entry{}, fmt.Errorf("permission denied: no read access to %q", req.KeyID)
+		}
+
+		out, err = s.mdb.GetShared(namespace, keyID)
+	} else {
+		out, err = s.mdb.Get(machineFP, req.KeyID)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("unable to get data: %w", err)
+		return mdb.Entry{}, fmt.Errorf("unable to get data: %w", err)
 	}
 
-	return &lupa.GetRspMsg{
-		Data: out,
-	}, nil
+	return out, nil
 }
 
 func (s *SSHToMDB) Put(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
@@ -73,6 +146,561 @@ func (s *SSHToMDB) Put(conn *ssh.ServerConn, msg interface{}) (interface{}, erro
 	}, nil
 }
 
+func (s *SSHToMDB) PutShared(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	machineFP, err := sshConToMachineFP(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.PutSharedReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	if err := policy.ValidateName(req.Namespace); err != nil {
+		return nil, fmt.Errorf("invalid namespace: %w", err)
+	}
+
+	keyID := req.KeyID
+	if keyID == "" {
+		keyUUID, err := uuid.NewV4()
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate key id: %w", err)
+		}
+
+		keyID = keyUUID.String()
+	}
+
+	if !validKeyID(keyID) {
+		return nil, fmt.Errorf("invalid key id %q", keyID)
+	}
+
+	subj := sshConToPolicySubject(conn, machineFP)
+	if !s.policies.Allowed(subj, req.Namespace, keyID, policy.AccessWrite) {
+		return nil, fmt.Errorf("permission denied: no write access to %q", lupa.SharedKeyID(req.Namespace, keyID))
+	}
+
+	if err := s.mdb.PutShared(req.Namespace, keyID, req.Data); err != nil {
+		return nil, fmt.Errorf("unable to store data: %w", err)
+	}
+
+	return &lupa.PutRspMsg{
+		KeyID: lupa.SharedKeyID(req.Namespace, keyID),
+	}, nil
+}
+
+// PutMany is a batch of puts, kept for clients predating batches.
+// Machine keys always get generated IDs, as with a single put.
+func (s *SSHToMDB) PutMany(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	req, ok := msg.(*lupa.PutManyReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	var items []lupa.PutItem
+	if err := json.Unmarshal(req.Data, &items); err != nil {
+		return nil, fmt.Errorf("invalid items: %w", err)
+	}
+
+	if len(items) == 0 {
+		return nil, errors.New("no items to store")
+	}
+
+	ops := make([]lupa.BatchOp, len(items))
+	names := make(map[string]struct{}, len(items))
+	for i, item := range items {
+		keyID := item.Name
+		if req.Namespace == "" {
+			keyID = ""
+		}
+
+		if keyID != "" {
+			if _, dup := names[keyID]; dup {
+				return nil, fmt.Errorf("duplicate key id %q", keyID)
+			}
+			names[keyID] = struct{}{}
+		}
+
+		ops[i] = lupa.BatchOp{
+			Op:        lupa.BatchOpPut,
+			KeyID:     keyID,
+			Data:      item.Data,
+			ExpiresAt: item.ExpiresAt,
+			TTL:       item.TTL,
+			MaxReads:  item.MaxReads,
+		}
+	}
+
+	rsp, err := s.batch(conn, req.Namespace, ops)
+	if err != nil {
+		return nil, err
+	}
+
+	keyIDs := make([]string, len(rsp.Results))
+	for i, r := range rsp.Results {
+		if r.Error != "" {
+			return nil, fmt.Errorf("unable to store %q: %s", r.KeyID, r.Error)
+		}
+
+		keyIDs[i] = r.KeyID
+	}
+
+	rspData, err := json.Marshal(keyIDs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal key ids: %w", err)
+	}
+
+	return &lupa.PutManyRspMsg{
+		Data: rspData,
+	}, nil
+}
+
+func (s *SSHToMDB) Batch(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	req, ok := msg.(*lupa.BatchReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	var ops []lupa.BatchOp
+	if err := json.Unmarshal(req.Data, &ops); err != nil {
+		return nil, fmt.Errorf("invalid batch: %w", err)
+	}
+
+	rsp, err := s.batch(conn, req.Namespace, ops)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(rsp)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal batch results: %w", err)
+	}
+
+	// applied batches are checked by the store, only errors of a rejected one may get here
+	if len(data) > maxBatchRspBytes {
+		return nil, fmt.Errorf("batch response is too large: %d bytes", len(data))
+	}
+
+	return &lupa.BatchRspMsg{
+		Data: data,
+	}, nil
+}
+
+// batch checks access to every operation before the store is touched and applies them atomically.
+func (s *SSHToMDB) batch(conn *ssh.ServerConn, namespace string, ops []lupa.BatchOp) (lupa.BatchRsp, error) {
+	machineFP, err := sshConToMachineFP(conn)
+	if err != nil {
+		return lupa.BatchRsp{}, err
+	}
+
+	if len(ops) == 0 {
+		return lupa.BatchRsp{}, errors.New("empty batch")
+	}
+
+	if len(ops) > maxBatchOps {
+		return lupa.BatchRsp{}, fmt.Errorf("too many batch operations: %d > %d", len(ops), maxBatchOps)
+	}
+
+	if namespace != "" {
+		if err := policy.ValidateName(namespace); err != nil {
+			return lupa.BatchRsp{}, fmt.Errorf("invalid namespace: %w", err)
+		}
+	}
+
+	subj := sshConToPolicySubject(conn, machineFP)
+	rsp := lupa.BatchRsp{
+		Results: make([]lupa.BatchResult, len(ops)),
+	}
+	mdbOps := make([]mdb.Op, len(ops))
+	now := time.Now()
+	denied := false
+	for i, op := range ops {
+		keyID := op.KeyID
+		if op.Op == lupa.BatchOpPut && keyID == "" {
+			keyUUID, err := uuid.NewV4()
+			if err != nil {
+				return lupa.BatchRsp{}, fmt.Errorf("unable to generate key id: %w", err)
+			}
+
+			keyID = keyUUID.String()
+		}
+
+		rsp.Results[i].KeyID = keyID
+		if namespace != "" {
+			rsp.Results[i].KeyID = lupa.SharedKeyID(namespace, keyID)
+		}
+
+		// machine key IDs can't contain "/", otherwise they would be taken for shared ones
+		invalidKeyID := !validKeyID(keyID) || (namespace == "" && strings.Contains(keyID, "/"))
+		if invalidKeyID {
+			rsp.Results[i].Error = fmt.Sprintf("invalid key id %q", keyID)
+			denied = true
+			continue
+		}
+
+		if namespace != "" {
+			access := policy.AccessWrite
+			if op.Op == lupa.BatchOpGet {
+				access = policy.AccessRead
+			}
+
+			if !s.policies.Allowed(subj, namespace, keyID, access) {
+				rsp.Results[i].Error = fmt.Sprintf("permission denied: no %s access", access)
+				denied = true
+				continue
+			}
+		}
+
+		expiresAt, err := expiryTime(op.ExpiresAt, op.TTL, now)
+		if err != nil {
+			rsp.Results[i].Error = fmt.Sprintf("invalid expiration: %v", err)
+			denied = true
+			continue
+		}
+
+		mdbOps[i] = mdb.Op{
+			Kind:        op.Op,
+			KeyID:       keyID,
+			Data:        op.Data,
+			ExpectedRev: op.ExpectedRev,
+			ExpiresAt:   expiresAt,
+			MaxReads:    op.MaxReads,
+		}
+	}
+
+	if denied {
+		return rsp, nil
+	}
+
+	// the response must fit a message, otherwise the batch is aborted before anything is written,
+	// including reads of read-limited keys
+	applied := rsp
+	applied.Applied = true
+	applied.Results = make([]lupa.BatchResult, len(rsp.Results))
+	checkRsp := func(results []mdb.OpResult) error {
+		copy(applied.Results, rsp.Results)
+		for i, r := range results {
+			applied.Results[i].Data = r.Data
+			applied.Results[i].Rev = r.Rev
+		}
+
+		data, err := json.Marshal(applied)
+		if err != nil {
+			return fmt.Errorf("unable to marshal batch results: %w", err)
+		}
+
+		if len(data) > maxBatchRspBytes {
+			return fmt.Errorf("batch response is too large: %d bytes", len(data))
+		}
+
+		return nil
+	}
+
+	var results []mdb.OpResult
+	if namespace == "" {
+		results, err = s.mdb.Batch(machineFP, mdbOps, checkRsp)
+	} else {
+		results, err = s.mdb.BatchShared(namespace, mdbOps, checkRsp)
+	}
+	if err == nil {
+		return applied, nil
+	}
+
+	if !errors.Is(err, mdb.ErrBatchFailed) {
+		return lupa.BatchRsp{}, fmt.Errorf("unable to apply batch: %w", err)
+	}
+
+	for i, r := range results {
+		if r.Err != nil {
+			rsp.Results[i].Error = r.Err.Error()
+		}
+	}
+
+	return rsp, nil
+}
+
+func (s *SSHToMDB) Keys(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	machineFP, err := sshConToMachineFP(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.ListKeysReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	var keys []mdb.KeyInfo
+	if req.Namespace != "" {
+		if err := policy.ValidateName(req.Namespace); err != nil {
+			return nil, fmt.Errorf("invalid namespace: %w", err)
+		}
+
+		keys, err = s.mdb.SharedKeys(req.Namespace)
+	} else {
+		keys, err = s.mdb.Keys(machineFP)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to list keys: %w", err)
+	}
+
+	subj := sshConToPolicySubject(conn, machineFP)
+	out := make([]lupa.KeyInfo, 0)
+	var next string
+	pageBytes := 0
+	for _, key := range keys {
+		if key.KeyID <= req.After {
+			continue
+		}
+
+		if req.Namespace != "" && !s.policies.Allowed(subj, req.Namespace, key.KeyID, policy.AccessRead) {
+			continue
+		}
+
+		info := lupa.KeyInfo{
+			KeyID:     key.KeyID,
+			Rev:       key.Rev,
+			ExpiresAt: key.ExpiresAt,
+			ReadsLeft: key.ReadsLeft,
+		}
+
+		data, err := json.Marshal(info)
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal key: %w", err)
+		}
+
+		pageBytes += len(data) + 1
+		if pageBytes > maxKeysPageBytes {
+			// keys stored before IDs were limited may not fit a page on their own
+			if len(out) == 0 {
+				return nil, fmt.Errorf("key %.64q... is too large to list", key.KeyID)
+			}
+
+			next = out[len(out)-1].KeyID
+			break
+		}
+
+		out = append(out, info)
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal keys: %w", err)
+	}
+
+	return &lupa.KeysRspMsg{
+		Data: data,
+		Next: next,
+	}, nil
+}
+
+func (s *SSHToMDB) CompareAndSwap(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	machineFP, err := sshConToMachineFP(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.CASReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	op := []mdb.Op{{
+		Kind:        mdb.OpPut,
+		Data:        req.Data,
+		ExpectedRev: &req.Rev,
+	}}
+
+	var results []mdb.OpResult
+	if namespace, keyID, ok := lupa.SplitSharedKeyID(req.KeyID); ok {
+		if !validKeyID(keyID) {
+			return nil, fmt.Errorf("invalid key id %q", req.KeyID)
+		}
+
+		subj := sshConToPolicySubject(conn, machineFP)
+		if !s.policies.Allowed(subj, namespace, keyID, policy.AccessWrite) {
+			return nil, fmt.Errorf("permission denied: no write access to %q", req.KeyID)
+		}
+
+		op[0].KeyID = keyID
+		results, err = s.mdb.BatchShared(namespace, op, nil)
+	} else {
+		if !validKeyID(req.KeyID) {
+			return nil, fmt.Errorf("invalid key id %q", req.KeyID)
+		}
+
+		op[0].KeyID = req.KeyID
+		results, err = s.mdb.Batch(machineFP, op, nil)
+	}
+	if errors.Is(err, mdb.ErrBatchFailed) {
+		err = results[0].Err
+		if errors.Is(err, mdb.ErrConflict) {
+			return nil, &lupa.Error{
+				Code: lupa.ErrCodeConflict,
+				Msg:  err.Error(),
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to store data: %w", err)
+	}
+
+	return &lupa.CASRspMsg{
+		KeyID: req.KeyID,
+		Rev:   results[0].Rev,
+	}, nil
+}
+
+func (s *SSHToMDB) Migrate(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	machineFP, err := sshConToMachineFP(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.MigrateReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	newKey, err := ssh.ParsePublicKey(req.NewPubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid new public key: %w", err)
+	}
+
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(req.Signature, &sig); err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	newFP := ssh.FingerprintSHA256(newKey)
+	if err := newKey.Verify(lupa.MigrationPayload(conn.SessionID(), newFP), &sig); err != nil {
+		return nil, fmt.Errorf("new key possession check failed: %w", err)
+	}
+
+	if err := s.migrate(machineFP, newFP, machineFP); err != nil {
+		return nil, err
+	}
+
+	log.Info().
+		Str("from_fp", machineFP).
+		Str("to_fp", newFP).
+		Str("actor", machineFP).
+		Msg("machine migrated")
+
+	return &lupa.MigrateRspMsg{
+		FromFP: machineFP,
+		ToFP:   newFP,
+	}, nil
+}
+
+func (s *SSHToMDB) AdminMigrate(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	actorFP, err := sshConRequireAdmin(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.AdminMigrateReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	if err := s.migrate(req.FromFP, req.ToFP, actorFP); err != nil {
+		return nil, err
+	}
+
+	log.Info().
+		Str("from_fp", req.FromFP).
+		Str("to_fp", req.ToFP).
+		Str("actor", actorFP).
+		Msg("machine migrated")
+
+	return &lupa.MigrateRspMsg{
+		FromFP: req.FromFP,
+		ToFP:   req.ToFP,
+	}, nil
+}
+
+// migrate moves secrets, labels, fingerprint rule subjects and source restrictions of a machine under toFP.
+// Policies and sources are moved first and moved back if any later step fails.
+func (s *SSHToMDB) migrate(fromFP string, toFP string, actor string) error {
+	if err := s.policies.Rekey(fromFP, toFP); err != nil {
+		return fmt.Errorf("unable to migrate machine policies: %w", err)
+	}
+
+	if err := s.sources.Rekey(fromFP, toFP); err != nil {
+		s.undoRekey("policies", s.policies.Rekey, fromFP, toFP)
+		return fmt.Errorf("unable to migrate machine sources: %w", err)
+	}
+
+	if err := s.mdb.Migrate(fromFP, toFP, actor); err != nil {
+		s.undoRekey("sources", s.sources.Rekey, fromFP, toFP)
+		s.undoRekey("policies", s.policies.Rekey, fromFP, toFP)
+		return fmt.Errorf("unable to migrate machine: %w", err)
+	}
+
+	return nil
+}
+
+func (s *SSHToMDB) undoRekey(what string, rekey func(fromFP, toFP string) error, fromFP string, toFP string) {
+	if err := rekey(toFP, fromFP); err != nil {
+		log.Error().
+			Str("from_fp", fromFP).
+			Str("to_fp", toFP).
+			Err(err).
+			Msgf("unable to move machine %s back after a failed migration", what)
+	}
+}
+
+// expiryTime resolves the expiration of a put value given either as a time or TTL.
+func expiryTime(expiresAt *time.Time, ttl time.Duration, now time.Time) (*time.Time, error) {
+	switch {
+	case expiresAt != nil && ttl != 0:
+		return nil, errors.New("expiration time and TTL are mutually exclusive")
+	case ttl < 0:
+		return nil, fmt.Errorf("negative TTL: %s", ttl)
+	case ttl > 0:
+		out := now.Add(ttl).UTC()
+		return &out, nil
+	case expiresAt == nil:
+		return nil, nil
+	case !expiresAt.After(now):
+		return nil, fmt.Errorf("expiration time %s is in the past", expiresAt.Format(time.RFC3339))
+	}
+
+	out := expiresAt.UTC()
+	return &out, nil
+}
+
+func sshConRequireAdmin(conn *ssh.ServerConn) (string, error) {
+	role, err := sshConExtension(conn, sshd.ExtensionRole)
+	if err != nil {
+		return "", err
+	}
+
+	if role != RoleAdmin {
+		return "", errors.New("permission denied: admin role required")
+	}
+
+	return sshConToMachineFP(conn)
+}
+
+// validKeyID reports whether keyID is fine to store a key under.
+func validKeyID(keyID string) bool {
+	return len(keyID) <= maxKeyIDLen && sharedKeyRe.MatchString(keyID) && !strings.Contains(keyID, "..")
+}
+
+func sshConToPolicySubject(conn *ssh.ServerConn, machineFP string) policy.Subject {
+	out := policy.Subject{
+		FP: machineFP,
+	}
+
+	if principals, _ := sshConExtension(conn, sshd.ExtensionPrincipals); principals != "" {
+		out.Principals = strings.Split(principals, ",")
+	}
+
+	return out
+}
+
 func sshConToMachineFP(conn *ssh.ServerConn) (string, error) {
 	return sshConExtension(conn, sshd.ExtensionPubFp)
 }
@@ -0,0 +1,440 @@
+package lupad
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/buglloc/lupa/internal/config"
+	"github.com/buglloc/lupa/internal/mdb"
+	"github.com/buglloc/lupa/internal/netacl"
+	"github.com/buglloc/lupa/internal/policy"
+	"github.com/buglloc/lupa/internal/sshd"
+	"github.com/buglloc/lupa/pkg/lupa"
+)
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+
+	return priv
+}
+
+// newTestClient runs handlers over a fresh store and returns a client connected to them.
+func newTestClient(t *testing.T) *lupa.Client {
+	t.Helper()
+
+	return newTestEnv(t).client
+}
+
+// testEnv is a client connected to handlers together with the stores behind them.
+type testEnv struct {
+	client    *lupa.Client
+	store     *mdb.MachineDB
+	policies  *policy.Store
+	sources   *netacl.Store
+	machineFP string
+}
+
+// newTestEnv is newTestClient also returning the stores and the machine fingerprint of the client.
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	dir := t.TempDir()
+	pemKey, err := ssh.MarshalPrivateKey(newTestKey(t), "")
+	if err != nil {
+		t.Fatalf("unable to marshal host key: %v", err)
+	}
+
+	hostKeyPath := filepath.Join(dir, "ssh_host_ed25519_key")
+	if err := os.WriteFile(hostKeyPath, pem.EncodeToMemory(pemKey), 0600); err != nil {
+		t.Fatalf("unable to write host key: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to pick a port: %v", err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	srv, err := sshd.NewServer(&sshd.Config{
+		SSH: config.SSH{
+			Addr:     addr,
+			HostKeys: []string{hostKeyPath},
+		},
+		CheckUserKey: func(_ ssh.ConnMetadata, _ ssh.PublicKey) (string, error) {
+			return "user", nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unable to create server: %v", err)
+	}
+
+	store, err := mdb.NewMachineDB(mdb.Config{StorePath: t.TempDir()})
+	if err != nil {
+		t.Fatalf("unable to create store: %v", err)
+	}
+
+	policies, err := policy.NewStore(filepath.Join(dir, "policies.json"))
+	if err != nil {
+		t.Fatalf("unable to create policies: %v", err)
+	}
+
+	sources, err := netacl.NewStore(filepath.Join(dir, "sources.json"))
+	if err != nil {
+		t.Fatalf("unable to create sources: %v", err)
+	}
+
+	BindHandlers(store, policies, sources, srv)
+	go func() { _ = srv.ListenAndServe() }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !srv.Listening() {
+		if time.Now().After(deadline) {
+			t.Fatal("server is not listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	signer, err := ssh.NewSignerFromKey(newTestKey(t))
+	if err != nil {
+		t.Fatalf("unable to create signer: %v", err)
+	}
+
+	sshc, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	t.Cleanup(func() { _ = sshc.Close() })
+
+	client, err := lupa.NewClient(sshc)
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+
+	return &testEnv{
+		client:    client,
+		store:     store,
+		policies:  policies,
+		sources:   sources,
+		machineFP: ssh.FingerprintSHA256(signer.PublicKey()),
+	}
+}
+
+func TestCompareAndSwapConflict(t *testing.T) {
+	client := newTestClient(t)
+
+	rev, err := client.CompareAndSwap("key", 0, []byte("v1"))
+	if err != nil {
+		t.Fatalf("unable to create key: %v", err)
+	}
+
+	if _, err := client.CompareAndSwap("key", 0, []byte("v2")); !errors.Is(err, lupa.ErrConflict) {
+		t.Fatalf("create of an existing key: error = %v, want %v", err, lupa.ErrConflict)
+	}
+
+	if _, err := client.CompareAndSwap("key", rev, []byte("v2")); err != nil {
+		t.Fatalf("unable to update key: %v", err)
+	}
+
+	if _, err := client.CompareAndSwap("key", rev, []byte("v3")); !errors.Is(err, lupa.ErrConflict) {
+		t.Fatalf("update at a stale revision: error = %v, want %v", err, lupa.ErrConflict)
+	}
+
+	// a deleted and recreated key must not be taken for the one read before
+	stale, err := client.CompareAndSwap("other", 0, []byte("v1"))
+	if err != nil {
+		t.Fatalf("unable to create key: %v", err)
+	}
+
+	if _, err := client.Batch().Delete("other").Put("other", []byte("v2")).Commit(); err != nil {
+		t.Fatalf("unable to recreate key: %v", err)
+	}
+
+	if _, err := client.CompareAndSwap("other", stale, []byte("v3")); !errors.Is(err, lupa.ErrConflict) {
+		t.Fatalf("update of a recreated key: error = %v, want %v", err, lupa.ErrConflict)
+	}
+}
+
+func TestUpdateRetriesOnConflict(t *testing.T) {
+	client := newTestClient(t)
+
+	if _, err := client.CompareAndSwap("key", 0, []byte("a")); err != nil {
+		t.Fatalf("unable to create key: %v", err)
+	}
+
+	calls := 0
+	_, err := client.Update("key", 0, func(data []byte) ([]byte, error) {
+		calls++
+		if calls == 1 {
+			// a concurrent writer changes the key between the read and the write
+			_, rev, err := client.GetRev("key")
+			if err != nil {
+				return nil, err
+			}
+
+			if _, err := client.CompareAndSwap("key", rev, []byte("b")); err != nil {
+				return nil, err
+			}
+		}
+
+		return append(data, 'c'), nil
+	})
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	if calls != 2 {
+		t.Fatalf("update made %d attempts, want 2", calls)
+	}
+
+	data, err := client.Get("key")
+	if err != nil {
+		t.Fatalf("unable to get key: %v", err)
+	}
+
+	if string(data) != "bc" {
+		t.Fatalf("unexpected value %q, the concurrent write is lost", data)
+	}
+}
+
+func TestUpdateGivesUp(t *testing.T) {
+	client := newTestClient(t)
+
+	if _, err := client.CompareAndSwap("key", 0, []byte("a")); err != nil {
+		t.Fatalf("unable to create key: %v", err)
+	}
+
+	calls := 0
+	_, err := client.Update("key", 3, func(data []byte) ([]byte, error) {
+		calls++
+		_, rev, err := client.GetRev("key")
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := client.CompareAndSwap("key", rev, data); err != nil {
+			return nil, err
+		}
+
+		return data, nil
+	})
+	if !errors.Is(err, lupa.ErrConflict) {
+		t.Fatalf("update error = %v, want %v", err, lupa.ErrConflict)
+	}
+
+	if calls != 3 {
+		t.Fatalf("update made %d attempts, want 3", calls)
+	}
+}
+
+func TestKeysOversizedFirstKey(t *testing.T) {
+	env := newTestEnv(t)
+	client, store, machineFP := env.client, env.store, env.machineFP
+
+	// stored before key IDs were limited, the key doesn't fit a page on its own
+	longKeyID := strings.Repeat("k", maxKeysPageBytes)
+	_, err := store.Batch(machineFP, []mdb.Op{{Kind: mdb.OpPut, KeyID: longKeyID, Data: []byte("v")}}, nil)
+	if err != nil {
+		t.Fatalf("unable to put key: %v", err)
+	}
+
+	if _, err := client.Keys(""); err == nil {
+		t.Fatal("listing of an oversized key succeeded")
+	}
+
+	if _, err := client.Ping(); err != nil {
+		t.Fatalf("server is gone after listing: %v", err)
+	}
+
+	_, err = client.Batch().Put(strings.Repeat("k", maxKeyIDLen+1), []byte("v")).Commit()
+	if err == nil {
+		t.Fatal("key with a too long ID is stored")
+	}
+}
+
+func TestBatchTooLargeResponseIsNotApplied(t *testing.T) {
+	client := newTestClient(t)
+
+	value := []byte(strings.Repeat("v", maxBatchRspBytes/2))
+	for _, keyID := range []string{"a", "b", "old"} {
+		if _, err := client.Batch().Put(keyID, value).Commit(); err != nil {
+			t.Fatalf("unable to put %s: %v", keyID, err)
+		}
+	}
+
+	_, err := client.Batch().Put("new", []byte("new")).Delete("old").Get("a").Get("b").Commit()
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("batch with a too large response: error = %v", err)
+	}
+
+	if _, err := client.Get("new"); err == nil {
+		t.Fatal("put of a failed batch is applied")
+	}
+
+	if _, err := client.Get("old"); err != nil {
+		t.Fatalf("delete of a failed batch is applied: %v", err)
+	}
+}
+
+func TestBatchTooLargeResponseKeepsReadLimits(t *testing.T) {
+	env := newTestEnv(t)
+	client, store, machineFP := env.client, env.store, env.machineFP
+
+	value := []byte(strings.Repeat("v", maxBatchRspBytes/2))
+	_, err := store.Batch(machineFP, []mdb.Op{
+		{Kind: mdb.OpPut, KeyID: "once", Data: value, MaxReads: 1},
+		{Kind: mdb.OpPut, KeyID: "twice", Data: value, MaxReads: 2},
+	}, nil)
+	if err != nil {
+		t.Fatalf("unable to put keys: %v", err)
+	}
+
+	if _, err := client.Batch().Get("once").Get("twice").Commit(); err == nil {
+		t.Fatal("batch with a too large response succeeded")
+	}
+
+	keys, err := client.Keys("")
+	if err != nil {
+		t.Fatalf("unable to list keys: %v", err)
+	}
+
+	if len(keys) != 2 || keys[0].ReadsLeft != 1 || keys[1].ReadsLeft != 2 {
+		t.Fatalf("reads of a failed batch are counted: %+v", keys)
+	}
+
+	data, err := client.Get("once")
+	if err != nil {
+		t.Fatalf("read-once key is lost: %v", err)
+	}
+
+	if string(data) != string(value) {
+		t.Fatal("read-once key is changed")
+	}
+}
+
+func TestMigrateMovesPoliciesAndSources(t *testing.T) {
+	env := newTestEnv(t)
+
+	if _, err := env.client.Batch().Put("key", []byte("v")).Commit(); err != nil {
+		t.Fatalf("unable to put key: %v", err)
+	}
+
+	if err := env.policies.SetLabels(env.machineFP, []string{"web"}); err != nil {
+		t.Fatalf("unable to set labels: %v", err)
+	}
+
+	err := env.policies.SetRule(policy.Rule{
+		Name:      "own",
+		Namespace: "ns",
+		Subjects:  []string{policy.SubjectFingerprint + ":" + env.machineFP},
+		Read:      true,
+	})
+	if err != nil {
+		t.Fatalf("unable to set rule: %v", err)
+	}
+
+	if err := env.sources.SetAllowed(env.machineFP, []string{"192.0.2.0/24"}); err != nil {
+		t.Fatalf("unable to set sources: %v", err)
+	}
+
+	if err := env.sources.Pin(env.machineFP, "127.0.0.0/24"); err != nil {
+		t.Fatalf("unable to pin source: %v", err)
+	}
+
+	newSigner, err := ssh.NewSignerFromKey(newTestKey(t))
+	if err != nil {
+		t.Fatalf("unable to create signer: %v", err)
+	}
+
+	fromFP, toFP, err := env.client.Migrate(newSigner)
+	if err != nil {
+		t.Fatalf("unable to migrate: %v", err)
+	}
+
+	if fromFP != env.machineFP {
+		t.Fatalf("migrated from %s, want %s", fromFP, env.machineFP)
+	}
+
+	labels := env.policies.Labels()
+	if _, ok := labels[fromFP]; ok {
+		t.Fatal("labels are left under the old fingerprint")
+	}
+
+	if len(labels[toFP]) != 1 || labels[toFP][0] != "web" {
+		t.Fatalf("labels of the new fingerprint: %v", labels[toFP])
+	}
+
+	newSubj := policy.Subject{FP: toFP}
+	if !env.policies.Allowed(newSubj, "ns", "key", policy.AccessRead) {
+		t.Fatal("rule subject is not moved to the new fingerprint")
+	}
+
+	if env.policies.Allowed(policy.Subject{FP: fromFP}, "ns", "key", policy.AccessRead) {
+		t.Fatal("rule subject is left under the old fingerprint")
+	}
+
+	if _, ok := env.sources.Machine(fromFP); ok {
+		t.Fatal("sources are left under the old fingerprint")
+	}
+
+	m, ok := env.sources.Machine(toFP)
+	if !ok || len(m.Allowed) != 1 || m.Pinned != "127.0.0.0/24" {
+		t.Fatalf("sources of the new fingerprint: %+v", m)
+	}
+}
+
+func TestMigrateFailureKeepsPolicies(t *testing.T) {
+	env := newTestEnv(t)
+
+	if err := env.policies.SetLabels(env.machineFP, []string{"web"}); err != nil {
+		t.Fatalf("unable to set labels: %v", err)
+	}
+
+	if err := env.sources.SetAllowed(env.machineFP, []string{"192.0.2.0/24"}); err != nil {
+		t.Fatalf("unable to set sources: %v", err)
+	}
+
+	newSigner, err := ssh.NewSignerFromKey(newTestKey(t))
+	if err != nil {
+		t.Fatalf("unable to create signer: %v", err)
+	}
+
+	// nothing stored yet, so there are no secrets to move
+	if _, _, err := env.client.Migrate(newSigner); err == nil {
+		t.Fatal("migration of a machine without secrets succeeded")
+	}
+
+	if labels := env.policies.Labels(); len(labels[env.machineFP]) != 1 || len(labels) != 1 {
+		t.Fatalf("labels are changed by a failed migration: %v", labels)
+	}
+
+	if _, ok := env.sources.Machine(env.machineFP); !ok || len(env.sources.Machines()) != 1 {
+		t.Fatalf("sources are changed by a failed migration: %v", env.sources.Machines())
+	}
+}
@@ -0,0 +1,94 @@
+package lupad
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/buglloc/lupa/internal/metrics"
+)
+
+func (s *Server) newHTTPServer() *http.Server {
+	if s.cfg.HTTP.Addr == "" {
+		return nil
+	}
+
+	metrics.Default.OnCollect(func() {
+		stats, err := s.mdb.Stats()
+		if err != nil {
+			log.Warn().Err(err).Msg("unable to collect store stats")
+			return
+		}
+
+		metrics.RegisteredMachines.Set(float64(stats.Machines))
+		metrics.StoredSecrets.Set(float64(stats.Secrets))
+		metrics.StoredSecretBytes.Set(float64(stats.SecretBytes))
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", s.handleLiveness)
+	mux.HandleFunc("/readyz", s.handleReadiness)
+	return &http.Server{
+		Addr:    s.cfg.HTTP.Addr,
+		Handler: mux,
+	}
+}
+
+func (s *Server) serveHTTP() {
+	if s.httpd == nil {
+		return
+	}
+
+	log.Info().
+		Str("addr", s.httpd.Addr).
+		Msg("HTTP listening")
+
+	if err := s.httpd.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error().Err(err).Msg("HTTP server failed")
+	}
+}
+
+func (s *Server) handleLiveness(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (s *Server) handleReadiness(w http.ResponseWriter, _ *http.Request) {
+	checks := map[string]string{
+		"store":     "ok",
+		"host_keys": "ok",
+		"listener":  "ok",
+	}
+	ready := true
+
+	if err := s.mdb.CheckHealth(); err != nil {
+		checks["store"] = err.Error()
+		ready = false
+	}
+
+	if s.sshd.HostKeys() == 0 {
+		checks["host_keys"] = "no host keys loaded"
+		ready = false
+	}
+
+	if !s.sshd.Listening() {
+		checks["listener"] = "not accepting connections"
+		ready = false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	_ = json.NewEncoder(w).Encode(struct {
+		Ready  bool              `json:"ready"`
+		Checks map[string]string `json:"checks"`
+	}{
+		Ready:  ready,
+		Checks: checks,
+	})
+}
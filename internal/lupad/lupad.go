@@ -3,19 +3,43 @@ package lupad
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
 
+	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/ssh"
 
+	"github.com/buglloc/lupa/internal/audit"
+	"github.com/buglloc/lupa/internal/authkeys"
 	"github.com/buglloc/lupa/internal/config"
 	"github.com/buglloc/lupa/internal/mdb"
+	"github.com/buglloc/lupa/internal/netacl"
+	"github.com/buglloc/lupa/internal/policy"
+	"github.com/buglloc/lupa/internal/revoke"
 	"github.com/buglloc/lupa/internal/sshd"
 )
 
 type Server struct {
-	sshd    *sshd.Server
-	handler *SSHToMDB
-	mdb     *mdb.MachineDB
-	cfg     *config.Config
+	sshd        *sshd.Server
+	handler     *SSHToMDB
+	revHandler  *SSHToRevocations
+	polHandler  *SSHToPolicies
+	srcHandler  *SSHToSources
+	banHandler  *SSHToBans
+	audHandler  *SSHToAudit
+	mdb         *mdb.MachineDB
+	sweeper     *mdb.Sweeper
+	revocations *revoke.List
+	policies    *policy.Store
+	sources     *netacl.Store
+	httpd       *http.Server
+	auditLog    *audit.Logger
+	cfgMu       sync.RWMutex
+	cfg         *config.Config
+	authKeys    map[string]*authkeys.File
+	ctx         context.Context
+	shutdownFn  context.CancelFunc
 }
 
 func NewServer(cfg *config.Config) (*Server, error) {
@@ -23,46 +47,126 @@ func NewServer(cfg *config.Config) (*Server, error) {
 		cfg: cfg,
 	}
 
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+
 	var err error
 	srv.sshd, err = sshd.NewServer(&sshd.Config{
-		SSH:          cfg.SSH,
-		CheckUserKey: srv.publicKeyCallback,
+		SSH:             cfg.SSH,
+		CheckUserKey:    srv.publicKeyCallback,
+		OnAuthenticated: srv.onAuthenticated,
+		OnRequest:       srv.auditRequest,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("unable to create SSHD server: %w", err)
 	}
 
-	srv.mdb, err = mdb.NewMachineDB(cfg.DB.StorePath)
+	srv.mdb, err = mdb.NewMachineDB(mdb.Config{
+		StorePath: cfg.DB.StorePath,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("unable to create DB: %w", err)
 	}
 
-	srv.handler = BindHandlers(srv.mdb, srv.sshd)
+	revocationsPath := cfg.Revocations.Path
+	if revocationsPath == "" {
+		revocationsPath = filepath.Join(cfg.DB.StorePath, "revoked_keys")
+	}
+
+	srv.revocations, err = revoke.NewList(revocationsPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load revocation list: %w", err)
+	}
+
+	srv.policies, err = policy.NewStore(filepath.Join(cfg.DB.StorePath, "policies.json"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load policies: %w", err)
+	}
+
+	srv.sources, err = netacl.NewStore(filepath.Join(cfg.DB.StorePath, "sources.json"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load source restrictions: %w", err)
+	}
+
+	srv.authKeys, err = srv.openAuthorizedKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.handler = BindHandlers(srv.mdb, srv.policies, srv.sources, srv.sshd)
+	srv.revHandler = BindRevocationHandlers(srv.revocations, srv.sshd)
+	srv.polHandler = BindPolicyHandlers(srv.policies, srv.sshd)
+	srv.srcHandler = BindSourceHandlers(srv.sources, srv.sshd)
+	srv.banHandler = BindBanHandlers(srv.sshd)
+	srv.auditLog, err = newAuditLogger(&audit.Config{
+		Path:       cfg.Audit.Path,
+		MaxSize:    cfg.Audit.MaxSizeMB << 20,
+		MaxBackups: cfg.Audit.MaxBackups,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit log: %w", err)
+	}
+	srv.audHandler = BindAuditHandlers(srv.auditLog, srv.sshd)
+	srv.sweeper = mdb.NewSweeper(srv.mdb, mdb.SweeperConfig{
+		Interval:  cfg.DB.SweepInterval,
+		OnExpired: srv.onKeyExpired,
+	})
+
+	srv.httpd = srv.newHTTPServer()
+	srv.ctx, srv.shutdownFn = context.WithCancel(context.Background())
 	return srv, nil
 }
 
 func (s *Server) ListenAndServe() error {
+	go s.revocations.Watch(s.ctx, s.currentConfig().Revocations.CheckInterval)
+	go s.watchAuthorizedKeys(s.ctx, s.currentConfig().AuthorizedKeys.CheckInterval)
+	go s.sweeper.Run(s.ctx)
+	go s.serveHTTP()
+
 	return s.sshd.ListenAndServe()
 }
 
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.sshd.Shutdown(ctx)
+	s.shutdownFn()
+	if s.httpd != nil {
+		if err := s.httpd.Shutdown(ctx); err != nil {
+			log.Warn().Err(err).Msg("HTTP shutdown failed")
+		}
+	}
+
+	err := s.sshd.Shutdown(ctx)
+	if s.auditLog != nil {
+		if err := s.auditLog.Close(); err != nil {
+			log.Warn().Err(err).Msg("unable to close audit log")
+		}
+	}
+
+	return err
 }
 
-func (s *Server) publicKeyCallback(user string, pubKey ssh.PublicKey) (string, error) {
+func (s *Server) publicKeyCallback(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (string, error) {
+	user := conn.User()
 	targetFp := ssh.FingerprintSHA256(pubKey)
-	userInfo, ok := s.cfg.Users[user]
-	if ok {
-		for _, key := range userInfo.SHA256Keys {
-			if targetFp == key {
-				return userInfo.Role, nil
-			}
-		}
+	if reason, revoked := s.revocations.IsRevoked(pubKey); revoked {
+		log.Warn().
+			Str("user", user).
+			Str("fingerprint", targetFp).
+			Str("reason", reason).
+			Msg("revoked key rejected")
+		return RoleNone, fmt.Errorf("key %s is revoked", targetFp)
+	}
 
-		return RoleNone, fmt.Errorf("unknown key %s", targetFp)
+	cfg := s.currentConfig()
+	if userInfo, ok := cfg.Users[user]; ok {
+		return s.checkUserKey(user, userInfo, pubKey, conn.RemoteAddr())
 	}
 
-	if s.cfg.AllowRegistration || s.mdb.IsMachineExists(targetFp) {
+	if cfg.AllowRegistration || s.mdb.IsMachineExists(targetFp) {
+		if err := s.checkMachineSource(targetFp, conn.RemoteAddr()); err != nil {
+			return RoleNone, err
+		}
+
 		return RoleUser, nil
 	}
 	return RoleNone, fmt.Errorf("user %q was not found", user)
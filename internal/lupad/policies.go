@@ -0,0 +1,150 @@
+package lupad
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/buglloc/lupa/internal/policy"
+	"github.com/buglloc/lupa/internal/sshd"
+	"github.com/buglloc/lupa/pkg/lupa"
+)
+
+type SSHToPolicies struct {
+	store *policy.Store
+}
+
+func BindPolicyHandlers(store *policy.Store, sshSrv *sshd.Server) *SSHToPolicies {
+	out := &SSHToPolicies{
+		store: store,
+	}
+
+	sshSrv.AddHandler("admin-policy-set", out.SetPolicy)
+	sshSrv.AddHandler("admin-policy-delete", out.DeletePolicy)
+	sshSrv.AddHandler("admin-policies", out.List)
+	sshSrv.AddHandler("admin-labels-set", out.SetLabels)
+	return out
+}
+
+func (s *SSHToPolicies) SetPolicy(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	actorFP, err := sshConRequireAdmin(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.SetPolicyReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	err = s.store.SetRule(policy.Rule{
+		Name:      req.Name,
+		Namespace: req.Namespace,
+		Subjects:  req.Subjects,
+		Prefixes:  req.Prefixes,
+		Read:      req.Read,
+		Write:     req.Write,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to set policy: %w", err)
+	}
+
+	log.Info().
+		Str("name", req.Name).
+		Str("namespace", req.Namespace).
+		Strs("subjects", req.Subjects).
+		Strs("prefixes", req.Prefixes).
+		Bool("read", req.Read).
+		Bool("write", req.Write).
+		Str("actor", actorFP).
+		Msg("policy set")
+
+	return &lupa.SuccessMsg{}, nil
+}
+
+func (s *SSHToPolicies) DeletePolicy(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	actorFP, err := sshConRequireAdmin(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.DeletePolicyReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	if err := s.store.DeleteRule(req.Name); err != nil {
+		return nil, fmt.Errorf("unable to delete policy: %w", err)
+	}
+
+	log.Info().
+		Str("name", req.Name).
+		Str("actor", actorFP).
+		Msg("policy deleted")
+
+	return &lupa.SuccessMsg{}, nil
+}
+
+func (s *SSHToPolicies) List(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	if _, err := sshConRequireAdmin(conn); err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.ListPoliciesReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	out := lupa.Policies{
+		Labels: s.store.Labels(),
+	}
+	for _, rule := range s.store.Rules() {
+		if req.Namespace != "" && rule.Namespace != req.Namespace {
+			continue
+		}
+
+		out.Rules = append(out.Rules, lupa.PolicyRule{
+			Name:      rule.Name,
+			Namespace: rule.Namespace,
+			Subjects:  rule.Subjects,
+			Prefixes:  rule.Prefixes,
+			Read:      rule.Read,
+			Write:     rule.Write,
+		})
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal policies: %w", err)
+	}
+
+	return &lupa.PoliciesRspMsg{
+		Data: data,
+	}, nil
+}
+
+func (s *SSHToPolicies) SetLabels(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	actorFP, err := sshConRequireAdmin(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.SetLabelsReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	if err := s.store.SetLabels(req.MachineFP, req.Labels); err != nil {
+		return nil, fmt.Errorf("unable to set labels: %w", err)
+	}
+
+	log.Info().
+		Str("machine_fp", req.MachineFP).
+		Strs("labels", req.Labels).
+		Str("actor", actorFP).
+		Msg("machine labels set")
+
+	return &lupa.SuccessMsg{}, nil
+}
@@ -0,0 +1,177 @@
+package lupad
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/buglloc/lupa/internal/config"
+)
+
+// Reload validates the new config and swaps it in, established connections are kept.
+// Users, registration, source restrictions, host keys and trusted CAs are applied immediately,
+// other changes are only reported as requiring a restart.
+// On error the current config stays in effect.
+func (s *Server) Reload(cfg *config.Config) error {
+	if err := validateConfig(cfg); err != nil {
+		return err
+	}
+
+	authKeys, err := s.openAuthorizedKeys(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := s.sshd.Reload(&cfg.SSH); err != nil {
+		return fmt.Errorf("unable to reload SSHD: %w", err)
+	}
+
+	s.cfgMu.Lock()
+	prev := s.cfg
+	next := keepRestartRequired(prev, cfg)
+	s.cfg = next
+	s.authKeys = authKeys
+	s.cfgMu.Unlock()
+
+	logUsersDiff(prev.Users, next.Users)
+	for _, name := range restartRequired(prev, cfg) {
+		log.Warn().Str("setting", name).Msg("config change requires restart, ignored")
+	}
+
+	log.Info().Msg("config reloaded")
+	return nil
+}
+
+func (s *Server) currentConfig() *config.Config {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+
+	return s.cfg
+}
+
+func logUsersDiff(prev, cur map[string]config.User) {
+	names := make([]string, 0, len(prev)+len(cur))
+	for name := range prev {
+		names = append(names, name)
+	}
+	for name := range cur {
+		if _, ok := prev[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		prevUser, wasKnown := prev[name]
+		curUser, isKnown := cur[name]
+		switch {
+		case !wasKnown:
+			log.Info().
+				Str("user", name).
+				Str("role", curUser.Role).
+				Strs("keys", curUser.SHA256Keys).
+				Msg("config: user added")
+		case !isKnown:
+			log.Info().
+				Str("user", name).
+				Str("role", prevUser.Role).
+				Msg("config: user removed")
+		default:
+			if prevUser.Role != curUser.Role {
+				log.Info().
+					Str("user", name).
+					Str("prev_role", prevUser.Role).
+					Str("role", curUser.Role).
+					Msg("config: user role changed")
+			}
+
+			added, removed := diffStrings(prevUser.SHA256Keys, curUser.SHA256Keys)
+			if len(added) > 0 || len(removed) > 0 {
+				log.Info().
+					Str("user", name).
+					Strs("added", added).
+					Strs("removed", removed).
+					Msg("config: user keys changed")
+			}
+
+			if prevUser.AuthorizedKeys != curUser.AuthorizedKeys {
+				log.Info().
+					Str("user", name).
+					Str("prev_authorized_keys", prevUser.AuthorizedKeys).
+					Str("authorized_keys", curUser.AuthorizedKeys).
+					Msg("config: user authorized keys changed")
+			}
+
+			if !reflect.DeepEqual(prevUser.From, curUser.From) {
+				log.Info().
+					Str("user", name).
+					Strs("prev_from", prevUser.From).
+					Strs("from", curUser.From).
+					Msg("config: user sources changed")
+			}
+		}
+	}
+}
+
+func diffStrings(prev, cur []string) ([]string, []string) {
+	inPrev := make(map[string]struct{}, len(prev))
+	for _, v := range prev {
+		inPrev[v] = struct{}{}
+	}
+
+	inCur := make(map[string]struct{}, len(cur))
+	for _, v := range cur {
+		inCur[v] = struct{}{}
+	}
+
+	var added, removed []string
+	for _, v := range cur {
+		if _, ok := inPrev[v]; !ok {
+			added = append(added, v)
+		}
+	}
+
+	for _, v := range prev {
+		if _, ok := inCur[v]; !ok {
+			removed = append(removed, v)
+		}
+	}
+
+	return added, removed
+}
+
+// keepRestartRequired returns a copy of cur with settings requiring a restart taken from prev,
+// so the stored config always reflects the running one.
+func keepRestartRequired(prev, cur *config.Config) *config.Config {
+	out := *cur
+	out.SSH.Addr = prev.SSH.Addr
+	out.SSH.RateLimit = prev.SSH.RateLimit
+	out.SSH.Limits = prev.SSH.Limits
+	out.DB = prev.DB
+	out.HTTP = prev.HTTP
+	out.Audit = prev.Audit
+	out.Revocations = prev.Revocations
+	out.AuthorizedKeys = prev.AuthorizedKeys
+	return &out
+}
+
+func restartRequired(prev, cur *config.Config) []string {
+	var out []string
+	check := func(name string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			out = append(out, name)
+		}
+	}
+
+	check("ssh.addr", prev.SSH.Addr, cur.SSH.Addr)
+	check("ssh.rate_limit", prev.SSH.RateLimit, cur.SSH.RateLimit)
+	check("ssh.limits", prev.SSH.Limits, cur.SSH.Limits)
+	check("db", prev.DB, cur.DB)
+	check("http", prev.HTTP, cur.HTTP)
+	check("audit", prev.Audit, cur.Audit)
+	check("revocations", prev.Revocations, cur.Revocations)
+	check("authorized_keys", prev.AuthorizedKeys, cur.AuthorizedKeys)
+	return out
+}
@@ -0,0 +1,105 @@
+package lupad
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/buglloc/lupa/internal/revoke"
+	"github.com/buglloc/lupa/internal/sshd"
+	"github.com/buglloc/lupa/pkg/lupa"
+)
+
+type SSHToRevocations struct {
+	list *revoke.List
+}
+
+func BindRevocationHandlers(list *revoke.List, sshSrv *sshd.Server) *SSHToRevocations {
+	out := &SSHToRevocations{
+		list: list,
+	}
+
+	sshSrv.AddHandler("admin-revoke", out.Revoke)
+	sshSrv.AddHandler("admin-unrevoke", out.Unrevoke)
+	sshSrv.AddHandler("admin-revocations", out.List)
+	return out
+}
+
+func (s *SSHToRevocations) Revoke(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	actorFP, err := sshConRequireAdmin(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.RevokeReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	if err := s.list.Add(req.Kind, req.Value); err != nil {
+		return nil, fmt.Errorf("unable to revoke: %w", err)
+	}
+
+	log.Info().
+		Str("kind", req.Kind).
+		Str("value", req.Value).
+		Str("actor", actorFP).
+		Msg("revocation added")
+
+	return &lupa.SuccessMsg{}, nil
+}
+
+func (s *SSHToRevocations) Unrevoke(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	actorFP, err := sshConRequireAdmin(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.RevokeReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	if err := s.list.Remove(req.Kind, req.Value); err != nil {
+		return nil, fmt.Errorf("unable to unrevoke: %w", err)
+	}
+
+	log.Info().
+		Str("kind", req.Kind).
+		Str("value", req.Value).
+		Str("actor", actorFP).
+		Msg("revocation removed")
+
+	return &lupa.SuccessMsg{}, nil
+}
+
+func (s *SSHToRevocations) List(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	if _, err := sshConRequireAdmin(conn); err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.ListRevocationsReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	entries := s.list.Entries()
+	if req.Kind == "" {
+		return &lupa.RevocationsRspMsg{
+			Entries: entries,
+		}, nil
+	}
+
+	out := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, req.Kind+" ") {
+			out = append(out, entry)
+		}
+	}
+
+	return &lupa.RevocationsRspMsg{
+		Entries: out,
+	}, nil
+}
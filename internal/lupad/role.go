@@ -5,3 +5,12 @@ const (
 	RoleUser  = "user"
 	RoleAdmin = "admin"
 )
+
+func isValidRole(role string) bool {
+	switch role {
+	case RoleUser, RoleAdmin:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,218 @@
+package lupad
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/buglloc/lupa/internal/config"
+	"github.com/buglloc/lupa/internal/netacl"
+	"github.com/buglloc/lupa/internal/sshd"
+	"github.com/buglloc/lupa/pkg/lupa"
+)
+
+type SSHToSources struct {
+	store *netacl.Store
+}
+
+func BindSourceHandlers(store *netacl.Store, sshSrv *sshd.Server) *SSHToSources {
+	out := &SSHToSources{
+		store: store,
+	}
+
+	sshSrv.AddHandler("admin-sources-set", out.SetSources)
+	sshSrv.AddHandler("admin-sources-unpin", out.Unpin)
+	sshSrv.AddHandler("admin-sources", out.List)
+	return out
+}
+
+func (s *SSHToSources) SetSources(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	actorFP, err := sshConRequireAdmin(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.SetSourcesReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	if err := s.store.SetAllowed(req.MachineFP, req.CIDRs); err != nil {
+		return nil, fmt.Errorf("unable to set machine sources: %w", err)
+	}
+
+	log.Info().
+		Str("machine_fp", req.MachineFP).
+		Strs("cidrs", req.CIDRs).
+		Str("actor", actorFP).
+		Msg("machine sources set")
+
+	return &lupa.SuccessMsg{}, nil
+}
+
+func (s *SSHToSources) Unpin(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	actorFP, err := sshConRequireAdmin(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.UnpinSourceReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	if err := s.store.Pin(req.MachineFP, ""); err != nil {
+		return nil, fmt.Errorf("unable to unpin machine: %w", err)
+	}
+
+	log.Info().
+		Str("machine_fp", req.MachineFP).
+		Str("actor", actorFP).
+		Msg("machine source unpinned")
+
+	return &lupa.SuccessMsg{}, nil
+}
+
+func (s *SSHToSources) List(conn *ssh.ServerConn, msg interface{}) (interface{}, error) {
+	if _, err := sshConRequireAdmin(conn); err != nil {
+		return nil, err
+	}
+
+	req, ok := msg.(*lupa.ListSourcesReqMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request type: %T", req)
+	}
+
+	out := make(map[string]lupa.MachineSources)
+	for fp, m := range s.store.Machines() {
+		if req.MachineFP != "" && req.MachineFP != fp {
+			continue
+		}
+
+		out[fp] = lupa.MachineSources{
+			Allowed: m.Allowed,
+			Pinned:  m.Pinned,
+		}
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal machine sources: %w", err)
+	}
+
+	return &lupa.SourcesRspMsg{
+		Data: data,
+	}, nil
+}
+
+func (s *Server) checkUserSource(user config.User, remoteAddr net.Addr) error {
+	allowed := user.From
+	if len(allowed) == 0 {
+		allowed = s.currentConfig().SourceRestrictions.DefaultAllow
+	}
+
+	return checkSource(allowed, remoteAddr)
+}
+
+func (s *Server) checkMachineSource(machineFP string, remoteAddr net.Addr) error {
+	cfg := s.currentConfig()
+	machine, _ := s.sources.Machine(machineFP)
+	allowed := machine.Allowed
+	if len(allowed) == 0 {
+		allowed = cfg.SourceRestrictions.DefaultAllow
+	}
+
+	if err := checkSource(allowed, remoteAddr); err != nil {
+		return err
+	}
+
+	if machine.Pinned == "" || !cfg.SourceRestrictions.PinEnforce {
+		return nil
+	}
+
+	return checkSource([]string{machine.Pinned}, remoteAddr)
+}
+
+// onAuthenticated pins machines existing in the store to the network they were first seen from
+// and alerts when a machine shows up from another one.
+func (s *Server) onAuthenticated(conn *ssh.ServerConn) error {
+	cfg := s.currentConfig()
+	pinMode := cfg.SourceRestrictions.Pin
+	if pinMode == netacl.PinOff {
+		return nil
+	}
+
+	if _, ok := cfg.Users[conn.User()]; ok {
+		return nil
+	}
+
+	machineFP, err := sshConToMachineFP(conn)
+	if err != nil {
+		return err
+	}
+
+	addr, err := netacl.RemoteAddr(conn.RemoteAddr())
+	if err != nil {
+		return err
+	}
+
+	machine, _ := s.sources.Machine(machineFP)
+	if machine.Pinned == "" {
+		if !s.mdb.IsMachineExists(machineFP) {
+			// unknown keys may connect with allow_registration, they are pinned once they store something
+			return nil
+		}
+
+		pinned, err := netacl.PinPrefix(pinMode, addr)
+		if err != nil {
+			return err
+		}
+
+		log.Info().
+			Str("machine_fp", machineFP).
+			Str("pinned", pinned.String()).
+			Msg("machine source pinned")
+		return s.sources.Pin(machineFP, pinned.String())
+	}
+
+	pinned, err := netip.ParsePrefix(machine.Pinned)
+	if err != nil {
+		return fmt.Errorf("invalid pinned source %q: %w", machine.Pinned, err)
+	}
+
+	if !pinned.Contains(addr) {
+		log.Error().
+			Str("machine_fp", machineFP).
+			Str("pinned", machine.Pinned).
+			Str("remote_addr", addr.String()).
+			Msg("machine source address changed")
+	}
+
+	return nil
+}
+
+func checkSource(allowed []string, remoteAddr net.Addr) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	addr, err := netacl.RemoteAddr(remoteAddr)
+	if err != nil {
+		return err
+	}
+
+	prefixes, err := netacl.ParsePrefixes(allowed)
+	if err != nil {
+		return err
+	}
+
+	if !netacl.Contains(prefixes, addr) {
+		return fmt.Errorf("source address %s is not allowed", addr)
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package lupad
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/buglloc/lupa/internal/authkeys"
+	"github.com/buglloc/lupa/internal/config"
+)
+
+// checkUserKey authorizes the key of a config user, either listed in sha256_keys
+// or found in the user authorized_keys file. Returns the user role.
+func (s *Server) checkUserKey(name string, user config.User, pubKey ssh.PublicKey, remoteAddr net.Addr) (string, error) {
+	targetFp := ssh.FingerprintSHA256(pubKey)
+	for _, key := range user.SHA256Keys {
+		if targetFp != key {
+			continue
+		}
+
+		if err := s.checkUserSource(user, remoteAddr); err != nil {
+			return RoleNone, err
+		}
+
+		return user.Role, nil
+	}
+
+	if user.AuthorizedKeys == "" {
+		return RoleNone, fmt.Errorf("unknown key %s", targetFp)
+	}
+
+	keys := s.authorizedKeys(user.AuthorizedKeys)
+	if keys == nil {
+		return RoleNone, fmt.Errorf("authorized keys %q are not loaded", user.AuthorizedKeys)
+	}
+
+	key, err := keys.Authorize(name, pubKey, remoteAddr, time.Now())
+	if err != nil {
+		return RoleNone, err
+	}
+
+	if err := s.checkUserSource(user, remoteAddr); err != nil {
+		return RoleNone, err
+	}
+
+	role := user.Role
+	if key.Role != "" {
+		role = key.Role
+	}
+
+	if !isValidRole(role) {
+		return RoleNone, fmt.Errorf("invalid role %q of key %s", role, key.Source)
+	}
+
+	return role, nil
+}
+
+func (s *Server) authorizedKeys(path string) *authkeys.File {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+
+	return s.authKeys[path]
+}
+
+// openAuthorizedKeys loads authorized_keys of config users, already loaded files are reused.
+func (s *Server) openAuthorizedKeys(cfg *config.Config) (map[string]*authkeys.File, error) {
+	s.cfgMu.RLock()
+	prev := s.authKeys
+	s.cfgMu.RUnlock()
+
+	out := make(map[string]*authkeys.File)
+	for name, user := range cfg.Users {
+		if user.AuthorizedKeys == "" {
+			continue
+		}
+
+		if _, ok := out[user.AuthorizedKeys]; ok {
+			continue
+		}
+
+		if keys, ok := prev[user.AuthorizedKeys]; ok {
+			out[user.AuthorizedKeys] = keys
+			continue
+		}
+
+		keys, err := authkeys.Open(user.AuthorizedKeys)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load authorized keys of user %q: %w", name, err)
+		}
+
+		logAuthorizedKeys(keys)
+		out[user.AuthorizedKeys] = keys
+	}
+
+	return out, nil
+}
+
+// watchAuthorizedKeys polls authorized_keys of config users for changes until ctx is done.
+func (s *Server) watchAuthorizedKeys(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.cfgMu.RLock()
+			files := make([]*authkeys.File, 0, len(s.authKeys))
+			for _, keys := range s.authKeys {
+				files = append(files, keys)
+			}
+			s.cfgMu.RUnlock()
+
+			for _, keys := range files {
+				changed, err := keys.Reload()
+				if err != nil {
+					log.Error().Str("path", keys.Path()).Err(err).Msg("unable to reload authorized keys")
+					continue
+				}
+
+				if changed {
+					logAuthorizedKeys(keys)
+				}
+			}
+		}
+	}
+}
+
+func logAuthorizedKeys(keys *authkeys.File) {
+	for _, problem := range keys.Problems() {
+		log.Warn().Str("path", keys.Path()).Str("problem", problem).Msg("authorized key skipped")
+	}
+
+	log.Info().Str("path", keys.Path()).Int("keys", len(keys.Keys())).Msg("authorized keys loaded")
+}
@@ -0,0 +1,192 @@
+package lupad
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/buglloc/lupa/internal/authkeys"
+	"github.com/buglloc/lupa/internal/config"
+	"github.com/buglloc/lupa/internal/netacl"
+	"github.com/buglloc/lupa/internal/sshd"
+)
+
+// ConfigError lists all semantic problems found in the config.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config: %s", strings.Join(e.Problems, "; "))
+}
+
+// CheckConfig validates the config semantics. Warnings are problems the server tolerates,
+// e.g. a missing host key when another one is usable.
+func CheckConfig(cfg *config.Config) (warnings []string, err error) {
+	var problems []string
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for _, name := range cfg.UnknownEnv {
+		warnings = append(warnings, fmt.Sprintf("unknown config environment variable %s", name))
+	}
+
+	if err := validateAddr(cfg.SSH.Addr); err != nil {
+		addProblem("invalid ssh.addr: %v", err)
+	}
+
+	if cfg.HTTP.Addr != "" {
+		if err := validateAddr(cfg.HTTP.Addr); err != nil {
+			addProblem("invalid http.addr: %v", err)
+		}
+	}
+
+	hostKeys := 0
+	for _, keyPath := range cfg.SSH.HostKeys {
+		rawKey, err := os.ReadFile(keyPath)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				warnings = append(warnings, fmt.Sprintf("host key %q not found", keyPath))
+				continue
+			}
+
+			addProblem("unable to read host key %q: %v", keyPath, err)
+			continue
+		}
+
+		key, err := ssh.ParsePrivateKey(rawKey)
+		if err != nil {
+			addProblem("malformed host key %q: %v", keyPath, err)
+			continue
+		}
+
+		hostKeys++
+		certPath := keyPath + "-cert.pub"
+		if _, err := os.Stat(certPath); err != nil {
+			continue
+		}
+
+		if err := sshd.ValidateHostCert(certPath, key); err != nil {
+			addProblem("malformed host certificate %q: %v", certPath, err)
+		}
+	}
+
+	if hostKeys == 0 {
+		addProblem("no usable host keys found")
+	}
+
+	for _, caFp := range cfg.SSH.TrustedUserCAs {
+		if err := validateFingerprint(caFp); err != nil {
+			addProblem("invalid ssh.trusted_user_cas entry %q: %v", caFp, err)
+		}
+	}
+
+	if cfg.SSH.RateLimit.HandshakesGlobal > 0 && cfg.SSH.RateLimit.HandshakesPerIP <= 0 {
+		warnings = append(warnings, "ssh.rate_limit.handshakes_global without handshakes_per_ip lets a single source exhaust it")
+	}
+
+	if _, err := netacl.ParsePrefixes(cfg.SourceRestrictions.DefaultAllow); err != nil {
+		addProblem("invalid source_restrictions.default_allow: %v", err)
+	}
+
+	switch cfg.SourceRestrictions.Pin {
+	case netacl.PinOff, netacl.PinAddress, netacl.PinSubnet:
+	default:
+		addProblem("invalid source_restrictions.pin: %q", cfg.SourceRestrictions.Pin)
+	}
+
+	userNames := make([]string, 0, len(cfg.Users))
+	for name := range cfg.Users {
+		userNames = append(userNames, name)
+	}
+	sort.Strings(userNames)
+
+	for _, name := range userNames {
+		user := cfg.Users[name]
+		if !isValidRole(user.Role) {
+			addProblem("invalid role of user %q: %q (must be %q or %q)", name, user.Role, RoleUser, RoleAdmin)
+		}
+
+		if len(user.SHA256Keys) == 0 && user.AuthorizedKeys == "" {
+			warnings = append(warnings, fmt.Sprintf("user %q has no keys", name))
+		}
+
+		if user.AuthorizedKeys != "" {
+			keys, err := authkeys.Open(user.AuthorizedKeys)
+			if err != nil {
+				addProblem("invalid authorized_keys of user %q: %v", name, err)
+			} else {
+				warnings = append(warnings, keys.Problems()...)
+				for _, key := range keys.Keys() {
+					if key.Role != "" && !isValidRole(key.Role) {
+						warnings = append(warnings, fmt.Sprintf("%s: invalid role %q", key.Source, key.Role))
+					}
+				}
+			}
+		}
+
+		for _, fp := range user.SHA256Keys {
+			if err := validateFingerprint(fp); err != nil {
+				addProblem("invalid key of user %q: %q: %v", name, fp, err)
+			}
+		}
+
+		if _, err := netacl.ParsePrefixes(user.From); err != nil {
+			addProblem("invalid from of user %q: %v", name, err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return warnings, &ConfigError{Problems: problems}
+	}
+	return warnings, nil
+}
+
+func validateConfig(cfg *config.Config) error {
+	warnings, err := CheckConfig(cfg)
+	for _, warning := range warnings {
+		log.Warn().Msg(warning)
+	}
+
+	return err
+}
+
+func validateAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+
+	return nil
+}
+
+func validateFingerprint(fp string) error {
+	if !strings.HasPrefix(fp, "SHA256:") {
+		return errors.New("must start with \"SHA256:\"")
+	}
+
+	raw, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(fp, "SHA256:"))
+	if err != nil {
+		return fmt.Errorf("invalid base64: %w", err)
+	}
+
+	if len(raw) != 32 {
+		return fmt.Errorf("invalid hash length %d", len(raw))
+	}
+
+	return nil
+}
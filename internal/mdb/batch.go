@@ -0,0 +1,164 @@
+package mdb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/buglloc/lupa/internal/metrics"
+)
+
+const (
+	OpGet    = "get"
+	OpPut    = "put"
+	OpDelete = "delete"
+)
+
+// ErrBatchFailed means one of the batch operations failed and none of them was applied.
+var ErrBatchFailed = errors.New("batch failed, no changes applied")
+
+// ErrConflict means the key revision doesn't match the expected one.
+var ErrConflict = errors.New("revision conflict")
+
+type Op struct {
+	Kind  string
+	KeyID string
+	Data  []byte
+	// ExpectedRev makes put and delete conditional on the current key revision,
+	// zero revision means the key must not exist. Nil skips the check.
+	ExpectedRev *uint64
+	// ExpiresAt is the expiration time of the put key
+	ExpiresAt *time.Time
+	// MaxReads limits the number of reads of the put key
+	MaxReads uint32
+}
+
+type OpResult struct {
+	Data []byte
+	Rev  uint64
+	Err  error
+}
+
+// Batch atomically applies operations to the machine keys in order, later operations see
+// the changes of earlier ones. If any operation fails nothing is written and ErrBatchFailed is returned
+// along with per-operation results.
+// Non-nil check gets the results before anything is written, its error aborts the batch.
+func (m *MachineDB) Batch(machineFP string, ops []Op, check func(results []OpResult) error) ([]OpResult, error) {
+	defer metrics.ObserveStoreOp("batch", time.Now())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.batchLocked(m.storePath(machineFP), fmt.Sprintf("machine %q", machineFP), ops, check)
+}
+
+// BatchShared is Batch for a shared namespace. Access checks are up to the caller.
+func (m *MachineDB) BatchShared(namespace string, ops []Op, check func(results []OpResult) error) ([]OpResult, error) {
+	defer metrics.ObserveStoreOp("batch_shared", time.Now())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.batchLocked(m.sharedPath(namespace), fmt.Sprintf("namespace %q", namespace), ops, check)
+}
+
+func (m *MachineDB) batchLocked(path string, owner string, ops []Op, check func(results []OpResult) error) ([]OpResult, error) {
+	file, err := m.getOrNewLocked(path)
+	if err != nil {
+		return nil, err
+	}
+	allData := file.Keys
+
+	// expired keys are kept for the sweeper, but otherwise treated as missing
+	now := m.now()
+	exists := func(keyID string) (Entry, bool) {
+		entry, ok := allData[keyID]
+		if !ok || entry.Expired(now) {
+			return Entry{}, false
+		}
+		return entry, true
+	}
+
+	failed := false
+	changed := false
+	out := make([]OpResult, len(ops))
+	for i, op := range ops {
+		if op.ExpectedRev != nil && op.Kind != OpGet {
+			cur, _ := exists(op.KeyID)
+			switch rev := cur.Rev; {
+			case rev == *op.ExpectedRev:
+			case rev == 0:
+				out[i].Err = fmt.Errorf("%w: key %q for %s does not exist, expected revision %d", ErrConflict, op.KeyID, owner, *op.ExpectedRev)
+			default:
+				out[i].Err = fmt.Errorf("%w: key %q for %s has revision %d, expected %d", ErrConflict, op.KeyID, owner, rev, *op.ExpectedRev)
+				out[i].Rev = rev
+			}
+
+			if out[i].Err != nil {
+				failed = true
+				continue
+			}
+		}
+
+		switch op.Kind {
+		case OpGet:
+			entry, ok := exists(op.KeyID)
+			if !ok {
+				out[i].Err = fmt.Errorf("key %q for %s was not found", op.KeyID, owner)
+				break
+			}
+			out[i].Data = entry.Data
+			out[i].Rev = entry.Rev
+			if entry.ReadsLeft > 0 {
+				entry.ReadsLeft--
+				if entry.ReadsLeft == 0 {
+					delete(allData, op.KeyID)
+				} else {
+					allData[op.KeyID] = entry
+				}
+				changed = true
+			}
+		case OpPut:
+			rev := file.nextRev()
+			allData[op.KeyID] = Entry{
+				Data:      op.Data,
+				Rev:       rev,
+				ExpiresAt: op.ExpiresAt,
+				ReadsLeft: op.MaxReads,
+			}
+			out[i].Rev = rev
+			changed = true
+		case OpDelete:
+			if _, ok := exists(op.KeyID); !ok {
+				out[i].Err = fmt.Errorf("key %q for %s was not found", op.KeyID, owner)
+				break
+			}
+			delete(allData, op.KeyID)
+			changed = true
+		default:
+			out[i].Err = fmt.Errorf("unknown operation %q", op.Kind)
+		}
+
+		if out[i].Err != nil {
+			failed = true
+		}
+	}
+
+	if failed {
+		return out, ErrBatchFailed
+	}
+
+	if check != nil {
+		if err := check(out); err != nil {
+			return nil, err
+		}
+	}
+
+	if changed {
+		if err := m.writeAllLocked(path, file); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
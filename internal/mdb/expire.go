@@ -0,0 +1,242 @@
+package mdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/buglloc/lupa/internal/metrics"
+)
+
+// KeyInfo describes a stored key without its value.
+type KeyInfo struct {
+	KeyID     string
+	Rev       uint64
+	ExpiresAt *time.Time
+	ReadsLeft uint32
+}
+
+// ExpiredKey is a key removed by Sweep, either of a machine or of a shared namespace.
+type ExpiredKey struct {
+	MachineFP string
+	Namespace string
+	KeyID     string
+	ExpiresAt time.Time
+}
+
+// Keys lists keys of the machine sorted by key ID, expired keys are skipped.
+func (m *MachineDB) Keys(machineFP string) ([]KeyInfo, error) {
+	defer metrics.ObserveStoreOp("keys", time.Now())
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.keysLocked(m.storePath(machineFP))
+}
+
+// SharedKeys lists keys of a shared namespace sorted by key ID, expired keys are skipped.
+// Access checks are up to the caller.
+func (m *MachineDB) SharedKeys(namespace string) ([]KeyInfo, error) {
+	defer metrics.ObserveStoreOp("keys_shared", time.Now())
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.keysLocked(m.sharedPath(namespace))
+}
+
+func (m *MachineDB) keysLocked(path string) ([]KeyInfo, error) {
+	file, err := m.getAllLocked(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	allData := file.Keys
+
+	now := m.now()
+	out := make([]KeyInfo, 0, len(allData))
+	for keyID, entry := range allData {
+		if entry.Expired(now) {
+			continue
+		}
+
+		out = append(out, KeyInfo{
+			KeyID:     keyID,
+			Rev:       entry.Rev,
+			ExpiresAt: entry.ExpiresAt,
+			ReadsLeft: entry.ReadsLeft,
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].KeyID < out[j].KeyID
+	})
+	return out, nil
+}
+
+// Sweep removes keys expired by now from all machines and shared namespaces and returns them.
+// A file failing to load or save is logged and skipped, so it doesn't stop expiration of the others.
+// Files are locked one at a time and only when they have expired keys, so gets aren't blocked by a sweep.
+func (m *MachineDB) Sweep(now time.Time) ([]ExpiredKey, error) {
+	defer metrics.ObserveStoreOp("sweep", time.Now())
+
+	m.mu.RLock()
+	files, err := os.ReadDir(m.basePath)
+	m.mu.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read store dir: %w", err)
+	}
+
+	var out []ExpiredKey
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		var owner ExpiredKey
+		switch {
+		case strings.HasPrefix(name, "m_"):
+			owner.MachineFP = base64ReToStd.Replace(strings.TrimSuffix(strings.TrimPrefix(name, "m_"), ".json"))
+		case strings.HasPrefix(name, "n_"):
+			owner.Namespace = strings.TrimSuffix(strings.TrimPrefix(name, "n_"), ".json")
+		default:
+			continue
+		}
+
+		expired, err := m.sweepFile(filepath.Join(m.basePath, name), owner, now)
+		if err != nil {
+			log.Error().Str("file", name).Err(err).Msg("unable to sweep expired keys")
+			continue
+		}
+
+		out = append(out, expired...)
+	}
+
+	return out, nil
+}
+
+func (m *MachineDB) sweepFile(path string, owner ExpiredKey, now time.Time) ([]ExpiredKey, error) {
+	m.mu.RLock()
+	file, err := m.getAllLocked(path)
+	m.mu.RUnlock()
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// migrated meanwhile
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if !hasExpired(file, now) {
+		return nil, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// the file might have been changed between the locks
+	file, err = m.getAllLocked(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var expired []ExpiredKey
+	for keyID, entry := range file.Keys {
+		if !entry.Expired(now) {
+			continue
+		}
+
+		key := owner
+		key.KeyID = keyID
+		key.ExpiresAt = *entry.ExpiresAt
+		expired = append(expired, key)
+		delete(file.Keys, keyID)
+	}
+
+	if len(expired) == 0 {
+		return nil, nil
+	}
+
+	if err := m.writeAllLocked(path, file); err != nil {
+		return nil, err
+	}
+
+	return expired, nil
+}
+
+func hasExpired(file *storeFile, now time.Time) bool {
+	for _, entry := range file.Keys {
+		if entry.Expired(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type SweeperConfig struct {
+	Interval time.Duration
+	// OnExpired is called for every removed key
+	OnExpired func(key ExpiredKey)
+}
+
+// Sweeper periodically removes expired keys from the store, by the store clock.
+type Sweeper struct {
+	db        *MachineDB
+	interval  time.Duration
+	onExpired func(key ExpiredKey)
+}
+
+func NewSweeper(db *MachineDB, cfg SweeperConfig) *Sweeper {
+	return &Sweeper{
+		db:        db,
+		interval:  cfg.Interval,
+		onExpired: cfg.OnExpired,
+	}
+}
+
+// Sweep removes keys expired by the store clock and reports them to OnExpired.
+func (s *Sweeper) Sweep() ([]ExpiredKey, error) {
+	expired, err := s.db.Sweep(s.db.now())
+	if s.onExpired != nil {
+		for _, key := range expired {
+			s.onExpired(key)
+		}
+	}
+
+	return expired, err
+}
+
+func (s *Sweeper) Run(ctx context.Context) {
+	if s.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Sweep(); err != nil {
+				log.Error().Err(err).Msg("unable to sweep expired keys")
+			}
+		}
+	}
+}
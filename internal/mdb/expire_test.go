@@ -0,0 +1,155 @@
+package mdb
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func newTestClockDB(t *testing.T) (*MachineDB, *testClock) {
+	t.Helper()
+
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	m, err := NewMachineDB(Config{
+		StorePath: t.TempDir(),
+		Now:       clock.Now,
+	})
+	if err != nil {
+		t.Fatalf("unable to create store: %v", err)
+	}
+
+	return m, clock
+}
+
+func putExpiring(t *testing.T, m *MachineDB, machineFP string, keyID string, expiresAt time.Time) {
+	t.Helper()
+
+	_, err := m.Batch(machineFP, []Op{{Kind: OpPut, KeyID: keyID, Data: []byte(keyID), ExpiresAt: &expiresAt}}, nil)
+	if err != nil {
+		t.Fatalf("unable to put %s: %v", keyID, err)
+	}
+}
+
+func TestExpiredKeysAreHidden(t *testing.T) {
+	m, clock := newTestClockDB(t)
+	putExpiring(t, m, "SHA256:a", "key", clock.Now().Add(time.Hour))
+
+	if _, err := m.Get("SHA256:a", "key"); err != nil {
+		t.Fatalf("unable to get key before expiration: %v", err)
+	}
+
+	clock.Add(time.Hour)
+	if _, err := m.Get("SHA256:a", "key"); err == nil {
+		t.Fatal("expired key is returned")
+	}
+
+	keys, err := m.Keys("SHA256:a")
+	if err != nil {
+		t.Fatalf("unable to list keys: %v", err)
+	}
+
+	if len(keys) != 0 {
+		t.Fatalf("expired key is listed: %+v", keys)
+	}
+
+	// the expired key is gone for CAS too, a new one may be created in its place
+	rev := uint64(0)
+	if _, err := m.Batch("SHA256:a", []Op{{Kind: OpPut, KeyID: "key", ExpectedRev: &rev}}, nil); err != nil {
+		t.Fatalf("unable to create key in place of the expired one: %v", err)
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	m, clock := newTestClockDB(t)
+	expiresAt := clock.Now().Add(time.Minute)
+	putExpiring(t, m, "SHA256:a", "short", expiresAt)
+	putExpiring(t, m, "SHA256:a", "long", clock.Now().Add(time.Hour))
+	putExpiring(t, m, "SHA256:b", "short", expiresAt)
+	if err := m.PutShared("ns", "plain", []byte("plain")); err != nil {
+		t.Fatalf("unable to put shared key: %v", err)
+	}
+
+	// a broken file must not stop expiration of the others
+	if err := os.WriteFile(m.storePath("SHA256:broken"), []byte("{"), 0600); err != nil {
+		t.Fatalf("unable to write broken file: %v", err)
+	}
+
+	var reported []ExpiredKey
+	sweeper := NewSweeper(m, SweeperConfig{
+		OnExpired: func(key ExpiredKey) {
+			reported = append(reported, key)
+		},
+	})
+
+	expired, err := sweeper.Sweep()
+	if err != nil {
+		t.Fatalf("sweep failed: %v", err)
+	}
+
+	if len(expired) != 0 {
+		t.Fatalf("keys expired ahead of time: %+v", expired)
+	}
+
+	clock.Add(time.Minute)
+	expired, err = sweeper.Sweep()
+	if err != nil {
+		t.Fatalf("sweep failed: %v", err)
+	}
+
+	want := []ExpiredKey{
+		{MachineFP: "SHA256:a", KeyID: "short", ExpiresAt: expiresAt},
+		{MachineFP: "SHA256:b", KeyID: "short", ExpiresAt: expiresAt},
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].MachineFP < expired[j].MachineFP
+	})
+	if !reflect.DeepEqual(expired, want) {
+		t.Fatalf("unexpected expired keys: %+v", expired)
+	}
+
+	if len(reported) != len(want) {
+		t.Fatalf("OnExpired got %d keys, want %d", len(reported), len(want))
+	}
+
+	// removed from the files, not just hidden
+	for _, fp := range []string{"SHA256:a", "SHA256:b"} {
+		file, err := m.getAllLocked(m.storePath(fp))
+		if err != nil {
+			t.Fatalf("unable to read %s: %v", fp, err)
+		}
+
+		if _, ok := file.Keys["short"]; ok {
+			t.Fatalf("expired key of %s is left in the store", fp)
+		}
+	}
+
+	if _, err := m.Get("SHA256:a", "long"); err != nil {
+		t.Fatalf("unexpired key is lost: %v", err)
+	}
+
+	if _, err := m.GetShared("ns", "plain"); err != nil {
+		t.Fatalf("key without expiration is lost: %v", err)
+	}
+}
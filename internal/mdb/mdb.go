@@ -9,8 +9,13 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/buglloc/lupa/internal/metrics"
 )
 
+const migrationsFilename = "migrations.jsonl"
+
 var base64StdToRe = strings.NewReplacer(
 	"+", "!",
 	"/", "-",
@@ -21,15 +26,48 @@ var base64ReToStd = strings.NewReplacer(
 	"-", "/",
 )
 
+// Entry is a stored key, its revision grows on every update. Revisions are given out by the machine file
+// and never reused, so a deleted and recreated key doesn't repeat a revision seen before.
+// Expired entries are treated as missing until the sweeper removes them.
+// Non-zero ReadsLeft limits the number of reads, the entry is deleted by the last one.
+type Entry struct {
+	Data      []byte     `json:"data"`
+	Rev       uint64     `json:"rev"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	ReadsLeft uint32     `json:"reads_left,omitempty"`
+}
+
+func (e Entry) Expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+// UnmarshalJSON also accepts bare values of stores written before revisions were introduced.
+func (e *Entry) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		e.Rev = 1
+		return json.Unmarshal(b, &e.Data)
+	}
+
+	type entry Entry
+	return json.Unmarshal(b, (*entry)(e))
+}
+
+type Config struct {
+	StorePath string
+	// Now is used as a clock for expiration when set
+	Now func() time.Time
+}
+
 type MachineDB struct {
 	mu       sync.RWMutex
 	basePath string
+	now      func() time.Time
 }
 
-func NewMachineDB(storePath string) (*MachineDB, error) {
-	stat, err := os.Stat(storePath)
+func NewMachineDB(cfg Config) (*MachineDB, error) {
+	stat, err := os.Stat(cfg.StorePath)
 	if err != nil && errors.Is(err, fs.ErrNotExist) {
-		err = os.MkdirAll(storePath, 0700)
+		err = os.MkdirAll(cfg.StorePath, 0700)
 	}
 
 	switch {
@@ -40,9 +78,16 @@ func NewMachineDB(storePath string) (*MachineDB, error) {
 		return nil, fmt.Errorf("invalid store path: %w", err)
 	}
 
-	return &MachineDB{
-		basePath: storePath,
-	}, nil
+	out := &MachineDB{
+		basePath: cfg.StorePath,
+		now:      cfg.Now,
+	}
+
+	if out.now == nil {
+		out.now = time.Now
+	}
+
+	return out, nil
 }
 
 func (m *MachineDB) List() ([]string, error) {
@@ -57,7 +102,7 @@ func (m *MachineDB) List() ([]string, error) {
 	out := make([]string, 0, len(files))
 	for _, file := range files {
 		machineID := file.Name()
-		if !strings.HasPrefix(machineID, "m_") {
+		if !strings.HasPrefix(machineID, "m_") || !strings.HasSuffix(machineID, ".json") {
 			continue
 		}
 
@@ -77,43 +122,284 @@ func (m *MachineDB) IsMachineExists(machineFP string) bool {
 	return err == nil && !info.IsDir()
 }
 
-func (m *MachineDB) Get(machineFP string, keyID string) ([]byte, error) {
+func (m *MachineDB) Get(machineFP string, keyID string) (Entry, error) {
+	defer metrics.ObserveStoreOp("get", time.Now())
+
+	return m.get(m.storePath(machineFP), fmt.Sprintf("machine %q", machineFP), keyID)
+}
+
+func (m *MachineDB) Put(machineFP string, keyID string, data []byte) error {
+	defer metrics.ObserveStoreOp("put", time.Now())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.putLocked(m.storePath(machineFP), keyID, data)
+}
+
+// GetShared returns the key from a shared namespace. Access checks are up to the caller.
+func (m *MachineDB) GetShared(namespace string, keyID string) (Entry, error) {
+	defer metrics.ObserveStoreOp("get_shared", time.Now())
+
+	return m.get(m.sharedPath(namespace), fmt.Sprintf("namespace %q", namespace), keyID)
+}
+
+// PutShared stores the key into a shared namespace. Access checks are up to the caller.
+func (m *MachineDB) PutShared(namespace string, keyID string, data []byte) error {
+	defer metrics.ObserveStoreOp("put_shared", time.Now())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.putLocked(m.sharedPath(namespace), keyID, data)
+}
+
+// get returns the entry, reads of read-limited entries are counted under the write lock
+// and stored before the entry is returned, so no read over the limit is ever served.
+// ReadsLeft of the returned entry is the number of reads left after this one.
+func (m *MachineDB) get(path string, owner string, keyID string) (Entry, error) {
+	m.mu.RLock()
+	out, err := m.getLocked(path, owner, keyID)
+	m.mu.RUnlock()
+	if err != nil || out.ReadsLeft == 0 {
+		return out, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, err := m.getAllLocked(path)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	out, ok := file.Keys[keyID]
+	if !ok || out.Expired(m.now()) {
+		return Entry{}, fmt.Errorf("key %q for %s was not found", keyID, owner)
+	}
+
+	// the key might have been replaced with an unlimited one meanwhile
+	if out.ReadsLeft == 0 {
+		return out, nil
+	}
+
+	out.ReadsLeft--
+	if out.ReadsLeft == 0 {
+		delete(file.Keys, keyID)
+	} else {
+		file.Keys[keyID] = out
+	}
+
+	if err := m.writeAllLocked(path, file); err != nil {
+		return Entry{}, err
+	}
+
+	return out, nil
+}
+
+func (m *MachineDB) getLocked(path string, owner string, keyID string) (Entry, error) {
+	file, err := m.getAllLocked(path)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	out, ok := file.Keys[keyID]
+	if !ok || out.Expired(m.now()) {
+		return Entry{}, fmt.Errorf("key %q for %s was not found", keyID, owner)
+	}
+
+	return out, nil
+}
+
+func (m *MachineDB) putLocked(path string, keyID string, data []byte) error {
+	file, err := m.getOrNewLocked(path)
+	if err != nil {
+		return err
+	}
+
+	file.Keys[keyID] = Entry{
+		Data: data,
+		Rev:  file.nextRev(),
+	}
+
+	return m.writeAllLocked(path, file)
+}
+
+func (m *MachineDB) writeAllLocked(path string, file *storeFile) error {
+	rawData, err := json.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("unable to marshal michine data: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(m.basePath, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("unable to create machine data: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	_, err = tmp.Write(rawData)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write machine data: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("unable to replace machine data: %w", err)
+	}
+
+	return m.syncDirLocked()
+}
+
+// syncDirLocked persists renames and removals of store files.
+func (m *MachineDB) syncDirLocked() error {
+	dir, err := os.Open(m.basePath)
+	if err != nil {
+		return fmt.Errorf("unable to open store dir: %w", err)
+	}
+	defer func() { _ = dir.Close() }()
+
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("unable to sync store dir: %w", err)
+	}
+
+	return nil
+}
+
+// CheckHealth verifies the store path is readable and writable.
+func (m *MachineDB) CheckHealth() error {
+	if _, err := os.ReadDir(m.basePath); err != nil {
+		return fmt.Errorf("store is not readable: %w", err)
+	}
+
+	f, err := os.CreateTemp(m.basePath, ".health-*")
+	if err != nil {
+		return fmt.Errorf("store is not writable: %w", err)
+	}
+
+	_ = f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return fmt.Errorf("unable to cleanup store health check: %w", err)
+	}
+
+	return nil
+}
+
+type Stats struct {
+	Machines    int
+	Secrets     int
+	SecretBytes int
+}
+
+// Stats counts machines, secrets and their total size, shared namespaces included.
+func (m *MachineDB) Stats() (Stats, error) {
+	defer metrics.ObserveStoreOp("stats", time.Now())
+
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	machineData, err := m.getAllLocked(machineFP)
+	files, err := os.ReadDir(m.basePath)
 	if err != nil {
-		return nil, err
+		return Stats{}, fmt.Errorf("unable to read store dir: %w", err)
 	}
 
-	out, ok := machineData[keyID]
-	if !ok {
-		return nil, fmt.Errorf("key %q for machine %q was not found", keyID, machineFP)
+	var out Stats
+	for _, file := range files {
+		name := file.Name()
+		isMachine := strings.HasPrefix(name, "m_")
+		if (!isMachine && !strings.HasPrefix(name, "n_")) || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		if isMachine {
+			out.Machines++
+		}
+
+		file, err := m.getAllLocked(filepath.Join(m.basePath, name))
+		if err != nil {
+			return Stats{}, err
+		}
+
+		out.Secrets += len(file.Keys)
+		for _, secret := range file.Keys {
+			out.SecretBytes += len(secret.Data)
+		}
 	}
 
 	return out, nil
 }
 
-func (m *MachineDB) Put(machineFP string, keyID string, data []byte) error {
+type MigrationRecord struct {
+	Time   time.Time `json:"time"`
+	FromFP string    `json:"from_fp"`
+	ToFP   string    `json:"to_fp"`
+	Actor  string    `json:"actor"`
+}
+
+// Migrate atomically moves all secrets of machine fromFP under toFP.
+// The migration is recorded in the store, linking both identities with the actor who requested it.
+func (m *MachineDB) Migrate(fromFP string, toFP string, actor string) error {
+	defer metrics.ObserveStoreOp("migrate", time.Now())
+
+	if fromFP == toFP {
+		return errors.New("source and target machines are the same")
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	machineData, err := m.getAllLocked(machineFP)
-	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+	fromPath := m.storePath(fromFP)
+	if _, err := os.Stat(fromPath); err != nil {
+		return fmt.Errorf("unable to get machine file: %w", err)
+	}
+
+	toPath := m.storePath(toFP)
+	if _, err := os.Stat(toPath); err == nil {
+		return fmt.Errorf("machine %q already exists", toFP)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("unable to check target machine: %w", err)
+	}
+
+	if err := os.Rename(fromPath, toPath); err != nil {
+		return fmt.Errorf("unable to move machine file: %w", err)
+	}
+
+	err := m.appendMigrationLocked(MigrationRecord{
+		Time:   time.Now().UTC(),
+		FromFP: fromFP,
+		ToFP:   toFP,
+		Actor:  actor,
+	})
+	if err != nil {
+		// keep both sides consistent: no secrets move without a record
+		_ = os.Rename(toPath, fromPath)
 		return err
 	}
 
-	if machineData == nil {
-		machineData = make(map[string][]byte)
+	return nil
+}
+
+func (m *MachineDB) appendMigrationLocked(rec MigrationRecord) error {
+	rawRec, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("unable to marshal migration record: %w", err)
 	}
 
-	machineData[keyID] = data
-	rawData, err := json.Marshal(machineData)
+	f, err := os.OpenFile(filepath.Join(m.basePath, migrationsFilename), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
-		return fmt.Errorf("unable to marshal michine data: %w", err)
+		return fmt.Errorf("unable to open migrations log: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if _, err := f.Write(append(rawRec, '\n')); err != nil {
+		return fmt.Errorf("unable to write migration record: %w", err)
 	}
 
-	return os.WriteFile(m.storePath(machineFP), rawData, 0600)
+	return f.Sync()
 }
 
 func (m *MachineDB) storePath(machineFP string) string {
@@ -121,16 +407,34 @@ func (m *MachineDB) storePath(machineFP string) string {
 	return filepath.Join(m.basePath, filename)
 }
 
-func (m *MachineDB) getAllLocked(machineFP string) (map[string][]byte, error) {
-	rawData, err := os.ReadFile(m.storePath(machineFP))
+func (m *MachineDB) sharedPath(namespace string) string {
+	filename := fmt.Sprintf("n_%s.json", namespace)
+	return filepath.Join(m.basePath, filename)
+}
+
+func (m *MachineDB) getAllLocked(path string) (*storeFile, error) {
+	rawData, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get machine file: %w", err)
 	}
 
-	var out map[string][]byte
+	var out storeFile
 	if err := json.Unmarshal(rawData, &out); err != nil {
 		return nil, fmt.Errorf("invalid machine data: %w", err)
 	}
 
+	return &out, nil
+}
+
+// getOrNewLocked is getAllLocked returning an empty file if it doesn't exist yet.
+func (m *MachineDB) getOrNewLocked(path string) (*storeFile, error) {
+	out, err := m.getAllLocked(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &storeFile{Keys: make(map[string]Entry)}, nil
+		}
+		return nil, err
+	}
+
 	return out, nil
 }
@@ -0,0 +1,215 @@
+package mdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestDB(t *testing.T) *MachineDB {
+	t.Helper()
+
+	m, err := NewMachineDB(Config{StorePath: t.TempDir()})
+	if err != nil {
+		t.Fatalf("unable to create store: %v", err)
+	}
+
+	return m
+}
+
+func TestListSkipsTemporaryFiles(t *testing.T) {
+	m := newTestDB(t)
+	if err := m.Put("SHA256:a/b+c", "key", []byte("value")); err != nil {
+		t.Fatalf("unable to put: %v", err)
+	}
+
+	if tmp, _ := filepath.Glob(filepath.Join(m.basePath, ".tmp-*")); len(tmp) > 0 {
+		t.Fatalf("put left temporary files: %v", tmp)
+	}
+
+	// leftovers of an interrupted write
+	for _, name := range []string{".tmp-123", "m_SHA256:d.json.tmp"} {
+		if err := os.WriteFile(filepath.Join(m.basePath, name), []byte("{"), 0600); err != nil {
+			t.Fatalf("unable to write %s: %v", name, err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(m.basePath, "m_*"))
+	if err != nil {
+		t.Fatalf("unable to list store: %v", err)
+	}
+
+	if len(files) != 2 {
+		t.Fatalf("unexpected store files: %v", files)
+	}
+
+	machines, err := m.List()
+	if err != nil {
+		t.Fatalf("unable to list machines: %v", err)
+	}
+
+	if !reflect.DeepEqual(machines, []string{"SHA256:a/b+c"}) {
+		t.Fatalf("unexpected machines: %v", machines)
+	}
+
+	stats, err := m.Stats()
+	if err != nil {
+		t.Fatalf("unable to get stats: %v", err)
+	}
+
+	if stats.Machines != 1 || stats.Secrets != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestRevisionsSurviveDelete(t *testing.T) {
+	m := newTestDB(t)
+	path := m.storePath("SHA256:a")
+
+	// a store written before the revision counter, the deleted key had the highest revision
+	legacy := `{"kept": {"data": "a2VwdA==", "rev": 2}, "plain": "cGxhaW4="}`
+	if err := os.WriteFile(path, []byte(legacy), 0600); err != nil {
+		t.Fatalf("unable to write legacy store: %v", err)
+	}
+
+	get, err := m.Get("SHA256:a", "plain")
+	if err != nil {
+		t.Fatalf("unable to get legacy key: %v", err)
+	}
+
+	if string(get.Data) != "plain" || get.Rev != 1 {
+		t.Fatalf("unexpected legacy key: %+v", get)
+	}
+
+	results, err := m.Batch("SHA256:a", []Op{
+		{Kind: OpDelete, KeyID: "kept"},
+		{Kind: OpPut, KeyID: "kept", Data: []byte("new")},
+	}, nil)
+	if err != nil {
+		t.Fatalf("batch failed: %v", err)
+	}
+
+	if results[1].Rev <= 2 {
+		t.Fatalf("recreated key reuses revision %d", results[1].Rev)
+	}
+
+	if _, err := m.Batch("SHA256:a", []Op{{Kind: OpDelete, KeyID: "kept"}}, nil); err != nil {
+		t.Fatalf("unable to delete: %v", err)
+	}
+
+	rev := results[1].Rev
+	results, err = m.Batch("SHA256:a", []Op{{Kind: OpPut, KeyID: "kept", Data: []byte("again")}}, nil)
+	if err != nil {
+		t.Fatalf("unable to put: %v", err)
+	}
+
+	if results[0].Rev <= rev {
+		t.Fatalf("recreated key reuses revision %d after %d", results[0].Rev, rev)
+	}
+}
+
+func TestGetReadOnceConcurrently(t *testing.T) {
+	m := newTestDB(t)
+	if _, err := m.Batch("SHA256:a", []Op{{Kind: OpPut, KeyID: "once", Data: []byte("secret"), MaxReads: 1}}, nil); err != nil {
+		t.Fatalf("unable to put: %v", err)
+	}
+
+	const readers = 16
+	var wg sync.WaitGroup
+	var served int32
+	start := make(chan struct{})
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			entry, err := m.Get("SHA256:a", "once")
+			if err == nil {
+				atomic.AddInt32(&served, 1)
+				if string(entry.Data) != "secret" || entry.ReadsLeft != 0 {
+					t.Errorf("unexpected entry: %+v", entry)
+				}
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if served != 1 {
+		t.Fatalf("read-once key served %d times", served)
+	}
+
+	file, err := m.getAllLocked(m.storePath("SHA256:a"))
+	if err != nil {
+		t.Fatalf("unable to read store: %v", err)
+	}
+
+	if _, ok := file.Keys["once"]; ok {
+		t.Fatal("read-once key is left in the store")
+	}
+}
+
+func TestBatchGetsReadLimitedKeyTwice(t *testing.T) {
+	m := newTestDB(t)
+	if _, err := m.Batch("SHA256:a", []Op{{Kind: OpPut, KeyID: "once", Data: []byte("secret"), MaxReads: 1}}, nil); err != nil {
+		t.Fatalf("unable to put: %v", err)
+	}
+
+	results, err := m.Batch("SHA256:a", []Op{
+		{Kind: OpGet, KeyID: "once"},
+		{Kind: OpGet, KeyID: "once"},
+	}, nil)
+	if !errors.Is(err, ErrBatchFailed) {
+		t.Fatalf("batch error = %v, want %v", err, ErrBatchFailed)
+	}
+
+	if results[0].Err != nil || results[1].Err == nil {
+		t.Fatalf("the second get must fail alone: %v, %v", results[0].Err, results[1].Err)
+	}
+
+	// the failed batch is not applied, so the read is not counted
+	entry, err := m.Get("SHA256:a", "once")
+	if err != nil {
+		t.Fatalf("key is consumed by a failed batch: %v", err)
+	}
+
+	if string(entry.Data) != "secret" {
+		t.Fatalf("unexpected data %q", entry.Data)
+	}
+
+	if _, err := m.Get("SHA256:a", "once"); err == nil {
+		t.Fatal("read-once key served twice")
+	}
+}
+
+func TestBatchCheckAbortsReads(t *testing.T) {
+	m := newTestDB(t)
+	if _, err := m.Batch("SHA256:a", []Op{{Kind: OpPut, KeyID: "once", Data: []byte("secret"), MaxReads: 1}}, nil); err != nil {
+		t.Fatalf("unable to put: %v", err)
+	}
+
+	errTooLarge := errors.New("too large")
+	_, err := m.Batch("SHA256:a", []Op{{Kind: OpGet, KeyID: "once"}}, func(results []OpResult) error {
+		if string(results[0].Data) != "secret" {
+			t.Errorf("check got unexpected results: %+v", results)
+		}
+		return errTooLarge
+	})
+	if !errors.Is(err, errTooLarge) {
+		t.Fatalf("batch error = %v, want %v", err, errTooLarge)
+	}
+
+	keys, err := m.Keys("SHA256:a")
+	if err != nil {
+		t.Fatalf("unable to list keys: %v", err)
+	}
+
+	if len(keys) != 1 || keys[0].ReadsLeft != 1 {
+		t.Fatalf("read of an aborted batch is counted: %+v", keys)
+	}
+}
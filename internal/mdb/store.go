@@ -0,0 +1,59 @@
+package mdb
+
+import "encoding/json"
+
+const storeFormat = 2
+
+// storeFile is a machine or shared namespace file. Rev is the last revision given out in the file,
+// it survives deletes of keys, so revisions are never reused.
+type storeFile struct {
+	Format int              `json:"format"`
+	Rev    uint64           `json:"rev"`
+	Keys   map[string]Entry `json:"keys"`
+}
+
+func (f *storeFile) nextRev() uint64 {
+	f.Rev++
+	return f.Rev
+}
+
+func (f *storeFile) MarshalJSON() ([]byte, error) {
+	type file storeFile
+	out := file(*f)
+	out.Format = storeFormat
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON also accepts files written before the format was introduced, a bare object of keys.
+// Their revision counter continues from the highest revision of the keys left.
+func (f *storeFile) UnmarshalJSON(b []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+
+	// entries are objects or strings, so a numeric format tells the current layout apart
+	var format int
+	if json.Unmarshal(fields["format"], &format) == nil && format == storeFormat {
+		type file storeFile
+		if err := json.Unmarshal(b, (*file)(f)); err != nil {
+			return err
+		}
+	} else {
+		f.Keys = nil
+		if err := json.Unmarshal(b, &f.Keys); err != nil {
+			return err
+		}
+
+		for _, entry := range f.Keys {
+			if entry.Rev > f.Rev {
+				f.Rev = entry.Rev
+			}
+		}
+	}
+
+	if f.Keys == nil {
+		f.Keys = make(map[string]Entry)
+	}
+	return nil
+}
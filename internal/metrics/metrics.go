@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+)
+
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// Default is the registry of lupad metrics.
+var Default = NewRegistry()
+
+var (
+	ConnectionsActive = Default.NewGauge(
+		"lupad_connections_active",
+		"Number of currently open connections.",
+	)
+	ConnectionsTotal = Default.NewCounter(
+		"lupad_connections_total",
+		"Total number of accepted connections.",
+	)
+	AuthTotal = Default.NewCounter(
+		"lupad_auth_total",
+		"Total number of authentication attempts by method and result.",
+		"method", "result",
+	)
+	RequestsTotal = Default.NewCounter(
+		"lupad_requests_total",
+		"Total number of lupa requests by type and outcome.",
+		"type", "outcome",
+	)
+	RequestDuration = Default.NewHistogram(
+		"lupad_request_duration_seconds",
+		"Lupa request processing latency by type.",
+		latencyBuckets,
+		"type",
+	)
+	StoreOpDuration = Default.NewHistogram(
+		"lupad_store_operation_duration_seconds",
+		"Store operation latency by operation.",
+		latencyBuckets,
+		"op",
+	)
+	StoredSecrets = Default.NewGauge(
+		"lupad_stored_secrets",
+		"Number of stored secrets.",
+	)
+	StoredSecretBytes = Default.NewGauge(
+		"lupad_stored_secret_bytes",
+		"Total size of stored secrets in bytes.",
+	)
+	RegisteredMachines = Default.NewGauge(
+		"lupad_registered_machines",
+		"Number of registered machines.",
+	)
+)
+
+// ObserveStoreOp records the store operation latency, meant to be deferred.
+func ObserveStoreOp(op string, start time.Time) {
+	StoreOpDuration.Observe(time.Since(start).Seconds(), op)
+}
+
+func Handler() http.Handler {
+	return Default.Handler()
+}
@@ -0,0 +1,300 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var labelEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+	"\n", `\n`,
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// Registry is a minimal collection of metrics exposed in Prometheus text format.
+type Registry struct {
+	mu        sync.Mutex
+	metrics   []metric
+	onCollect []func()
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// OnCollect registers a hook which is called before metrics are written,
+// e.g. to refresh gauges which are expensive to keep up to date.
+func (r *Registry) OnCollect(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.onCollect = append(r.onCollect, fn)
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	out := &Counter{
+		vec: newVec(name, help, labels),
+	}
+	r.register(out)
+	return out
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	out := &Gauge{
+		vec: newVec(name, help, labels),
+	}
+	r.register(out)
+	return out
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	out := &Histogram{
+		vec:     newVec(name, help, labels),
+		buckets: append([]float64(nil), buckets...),
+		series:  make(map[string]*histogramSeries),
+	}
+	sort.Float64s(out.buckets)
+	r.register(out)
+	return out
+}
+
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	hooks := append([]func(){}, r.onCollect...)
+	metrics := append([]metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	for _, hook := range hooks {
+		hook()
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.WriteText(w)
+	})
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+type vec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newVec(name, help string, labels []string) vec {
+	return vec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+func (v *vec) add(delta float64, labelValues []string) {
+	key := v.key(labelValues)
+
+	v.mu.Lock()
+	v.values[key] += delta
+	v.mu.Unlock()
+}
+
+func (v *vec) set(val float64, labelValues []string) {
+	key := v.key(labelValues)
+
+	v.mu.Lock()
+	v.values[key] = val
+	v.mu.Unlock()
+}
+
+func (v *vec) key(labelValues []string) string {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+
+	pairs := make([]string, len(v.labels))
+	for i, label := range v.labels {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, label, labelEscaper.Replace(labelValues[i]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (v *vec) writeSamples(w io.Writer, typ string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	writeHeader(w, v.name, v.help, typ)
+	if len(v.labels) == 0 && len(v.values) == 0 {
+		_, _ = fmt.Fprintf(w, "%s 0\n", v.name)
+		return
+	}
+
+	for _, key := range sortedKeys(v.values) {
+		_, _ = fmt.Fprintf(w, "%s%s %s\n", v.name, braces(key), formatFloat(v.values[key]))
+	}
+}
+
+// Counter is a monotonically increasing value, optionally partitioned by labels.
+type Counter struct {
+	vec
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("counter %s: negative delta", c.name))
+	}
+	c.add(delta, labelValues)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.writeSamples(w, "counter")
+}
+
+// Gauge is an arbitrary value, optionally partitioned by labels.
+type Gauge struct {
+	vec
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.add(1, labelValues)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.add(-1, labelValues)
+}
+
+func (g *Gauge) Set(val float64, labelValues ...string) {
+	g.set(val, labelValues)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.writeSamples(w, "gauge")
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Histogram counts observations in cumulative buckets, optionally partitioned by labels.
+type Histogram struct {
+	vec
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+func (h *Histogram) Observe(val float64, labelValues ...string) {
+	key := h.key(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = series
+	}
+
+	for i, bound := range h.buckets {
+		if val <= bound {
+			series.counts[i]++
+		}
+	}
+	series.sum += val
+	series.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := h.series[key]
+		for i, bound := range h.buckets {
+			_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, braces(joinLabels(key, `le="`+formatFloat(bound)+`"`)), series.counts[i])
+		}
+		_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, braces(joinLabels(key, `le="+Inf"`)), series.count)
+		_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", h.name, braces(key), formatFloat(series.sum))
+		_, _ = fmt.Fprintf(w, "%s_count%s %d\n", h.name, braces(key), series.count)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	_, _ = fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,224 @@
+package netacl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	PinOff     = ""
+	PinAddress = "address"
+	PinSubnet  = "subnet"
+)
+
+// Machine keeps source restrictions of a registered machine.
+type Machine struct {
+	Allowed []string `json:"allowed,omitempty"`
+	Pinned  string   `json:"pinned,omitempty"`
+}
+
+// Store keeps per machine source address allowlists and pinned first-seen networks.
+type Store struct {
+	mu       sync.RWMutex
+	path     string
+	machines map[string]Machine
+}
+
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path:     path,
+		machines: make(map[string]Machine),
+	}
+
+	rawState, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("unable to read source restrictions: %w", err)
+	}
+
+	if err := json.Unmarshal(rawState, &s.machines); err != nil {
+		return nil, fmt.Errorf("invalid source restrictions: %w", err)
+	}
+
+	if s.machines == nil {
+		s.machines = make(map[string]Machine)
+	}
+
+	return s, nil
+}
+
+func (s *Store) Machine(machineFP string) (Machine, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out, ok := s.machines[machineFP]
+	return out, ok
+}
+
+func (s *Store) Machines() map[string]Machine {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make(map[string]Machine, len(s.machines))
+	for fp, m := range s.machines {
+		out[fp] = m
+	}
+	return out
+}
+
+// SetAllowed replaces the machine allowlist, empty list drops it.
+func (s *Store) SetAllowed(machineFP string, allowed []string) error {
+	if _, err := ParsePrefixes(allowed); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.machines[machineFP]
+	m.Allowed = allowed
+	s.setLocked(machineFP, m)
+	return s.saveLocked()
+}
+
+// Pin records the network the machine was first seen from.
+func (s *Store) Pin(machineFP string, pinned string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.machines[machineFP]
+	m.Pinned = pinned
+	s.setLocked(machineFP, m)
+	return s.saveLocked()
+}
+
+// Rekey moves source restrictions of machine fromFP under toFP.
+func (s *Store) Rekey(fromFP string, toFP string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.machines[toFP]; ok {
+		return fmt.Errorf("machine %q already has source restrictions", toFP)
+	}
+
+	m, ok := s.machines[fromFP]
+	if !ok {
+		return nil
+	}
+
+	s.machines[toFP] = m
+	delete(s.machines, fromFP)
+	if err := s.saveLocked(); err != nil {
+		s.machines[fromFP] = m
+		delete(s.machines, toFP)
+		return err
+	}
+
+	return nil
+}
+
+func (s *Store) setLocked(machineFP string, m Machine) {
+	if len(m.Allowed) == 0 && m.Pinned == "" {
+		delete(s.machines, machineFP)
+		return
+	}
+
+	s.machines[machineFP] = m
+}
+
+func (s *Store) saveLocked() error {
+	rawState, err := json.Marshal(s.machines)
+	if err != nil {
+		return fmt.Errorf("unable to marshal source restrictions: %w", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, rawState, 0600); err != nil {
+		return fmt.Errorf("unable to write source restrictions: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("unable to replace source restrictions: %w", err)
+	}
+
+	return nil
+}
+
+// ParsePrefixes parses CIDRs, plain addresses are treated as single host networks.
+func ParsePrefixes(in []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(in))
+	for _, v := range in {
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", v, err)
+			}
+
+			out = append(out, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", v, err)
+		}
+
+		out = append(out, prefix.Masked())
+	}
+
+	return out, nil
+}
+
+// Contains reports whether addr belongs to any of the networks.
+func Contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RemoteAddr extracts the IP address of a connection peer.
+func RemoteAddr(addr net.Addr) (netip.Addr, error) {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		out, ok := netip.AddrFromSlice(tcpAddr.IP)
+		if !ok {
+			return netip.Addr{}, fmt.Errorf("invalid remote address: %s", addr)
+		}
+		return out.Unmap(), nil
+	}
+
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid remote address: %w", err)
+	}
+
+	return addrPort.Addr().Unmap(), nil
+}
+
+// PinPrefix returns the network to pin the address to: the address itself or its /24 (/64 for IPv6).
+func PinPrefix(mode string, addr netip.Addr) (netip.Prefix, error) {
+	switch mode {
+	case PinAddress:
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	case PinSubnet:
+		bits := 24
+		if addr.Is6() {
+			bits = 64
+		}
+		return addr.Prefix(bits)
+	default:
+		return netip.Prefix{}, fmt.Errorf("unknown pin mode: %s", mode)
+	}
+}
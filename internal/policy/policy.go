@@ -0,0 +1,373 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	SubjectFingerprint = "fp"
+	SubjectLabel       = "label"
+	SubjectPrincipal   = "principal"
+)
+
+var nameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+type Access int
+
+const (
+	AccessRead Access = iota
+	AccessWrite
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessRead:
+		return "read"
+	case AccessWrite:
+		return "write"
+	default:
+		return fmt.Sprintf("access_%d", a)
+	}
+}
+
+// Rule grants subjects access to keys with given prefixes in a shared namespace.
+type Rule struct {
+	Name      string   `json:"name"`
+	Namespace string   `json:"namespace"`
+	Subjects  []string `json:"subjects"`
+	Prefixes  []string `json:"prefixes"`
+	Read      bool     `json:"read"`
+	Write     bool     `json:"write"`
+}
+
+// Subject is an authenticated machine, principals are set only for certificates signed by a trusted CA.
+type Subject struct {
+	FP         string
+	Principals []string
+}
+
+type state struct {
+	Rules  map[string]Rule     `json:"rules"`
+	Labels map[string][]string `json:"labels"`
+}
+
+// clone copies the maps, so changes are made on the copy and swapped in only once saved.
+func (st state) clone() state {
+	out := state{
+		Rules:  make(map[string]Rule, len(st.Rules)),
+		Labels: make(map[string][]string, len(st.Labels)),
+	}
+
+	for name, rule := range st.Rules {
+		out.Rules[name] = rule
+	}
+
+	for fp, labels := range st.Labels {
+		out.Labels[fp] = labels
+	}
+
+	return out
+}
+
+// Store keeps access rules and machine labels. Everything not allowed by a rule is denied.
+type Store struct {
+	mu    sync.RWMutex
+	path  string
+	state state
+}
+
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path: path,
+		state: state{
+			Rules:  make(map[string]Rule),
+			Labels: make(map[string][]string),
+		},
+	}
+
+	rawState, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("unable to read policies: %w", err)
+	}
+
+	if err := json.Unmarshal(rawState, &s.state); err != nil {
+		return nil, fmt.Errorf("invalid policies: %w", err)
+	}
+
+	if s.state.Rules == nil {
+		s.state.Rules = make(map[string]Rule)
+	}
+
+	if s.state.Labels == nil {
+		s.state.Labels = make(map[string][]string)
+	}
+
+	return s, nil
+}
+
+// ValidateName checks namespace and rule names.
+func ValidateName(name string) error {
+	if !nameRe.MatchString(name) {
+		return fmt.Errorf("invalid name %q", name)
+	}
+
+	return nil
+}
+
+func (s *Store) Allowed(subj Subject, namespace string, keyID string, access Access) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, rule := range s.state.Rules {
+		if rule.Namespace != namespace {
+			continue
+		}
+
+		switch access {
+		case AccessRead:
+			if !rule.Read {
+				continue
+			}
+		case AccessWrite:
+			if !rule.Write {
+				continue
+			}
+		default:
+			continue
+		}
+
+		if !matchPrefix(rule.Prefixes, keyID) {
+			continue
+		}
+
+		if s.matchSubjectLocked(rule.Subjects, subj) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Store) SetRule(rule Rule) error {
+	if err := ValidateName(rule.Name); err != nil {
+		return fmt.Errorf("invalid rule: %w", err)
+	}
+
+	if err := ValidateName(rule.Namespace); err != nil {
+		return fmt.Errorf("invalid rule namespace: %w", err)
+	}
+
+	if len(rule.Subjects) == 0 {
+		return errors.New("invalid rule: no subjects")
+	}
+
+	for _, subj := range rule.Subjects {
+		kind, value, _ := strings.Cut(subj, ":")
+		switch {
+		case value == "":
+			return fmt.Errorf("invalid rule subject %q: empty value", subj)
+		case kind == SubjectFingerprint, kind == SubjectLabel, kind == SubjectPrincipal:
+		default:
+			return fmt.Errorf("invalid rule subject %q: unknown kind %q", subj, kind)
+		}
+	}
+
+	if !rule.Read && !rule.Write {
+		return errors.New("invalid rule: grants no access")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.state.clone()
+	next.Rules[rule.Name] = rule
+	return s.saveLocked(next)
+}
+
+func (s *Store) DeleteRule(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.state.Rules[name]; !ok {
+		return fmt.Errorf("rule %q was not found", name)
+	}
+
+	next := s.state.clone()
+	delete(next.Rules, name)
+	return s.saveLocked(next)
+}
+
+func (s *Store) Rules() []Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make([]Rule, 0, len(s.state.Rules))
+	for _, rule := range s.state.Rules {
+		out = append(out, rule)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// SetLabels replaces machine labels, empty labels remove the machine entry.
+func (s *Store) SetLabels(machineFP string, labels []string) error {
+	for _, label := range labels {
+		if err := ValidateName(label); err != nil {
+			return fmt.Errorf("invalid label: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.state.clone()
+	if len(labels) == 0 {
+		delete(next.Labels, machineFP)
+	} else {
+		next.Labels[machineFP] = labels
+	}
+
+	return s.saveLocked(next)
+}
+
+func (s *Store) Labels() map[string][]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make(map[string][]string, len(s.state.Labels))
+	for fp, labels := range s.state.Labels {
+		out[fp] = append([]string(nil), labels...)
+	}
+	return out
+}
+
+// Rekey moves labels and fingerprint rule subjects of machine fromFP under toFP.
+// It refuses to merge into a machine that is already referenced, so the move can be undone by the reverse call.
+func (s *Store) Rekey(fromFP string, toFP string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.state.Labels[toFP]; ok {
+		return fmt.Errorf("machine %q already has labels", toFP)
+	}
+
+	fromSubj := SubjectFingerprint + ":" + fromFP
+	toSubj := SubjectFingerprint + ":" + toFP
+	for _, rule := range s.state.Rules {
+		if contains(rule.Subjects, toSubj) {
+			return fmt.Errorf("machine %q is already a subject of rule %q", toFP, rule.Name)
+		}
+	}
+
+	next := s.state.clone()
+	changed := false
+	if labels, ok := next.Labels[fromFP]; ok {
+		next.Labels[toFP] = labels
+		delete(next.Labels, fromFP)
+		changed = true
+	}
+
+	for name, rule := range next.Rules {
+		if !contains(rule.Subjects, fromSubj) {
+			continue
+		}
+
+		subjects := make([]string, len(rule.Subjects))
+		for i, subj := range rule.Subjects {
+			if subj == fromSubj {
+				subj = toSubj
+			}
+			subjects[i] = subj
+		}
+
+		rule.Subjects = subjects
+		next.Rules[name] = rule
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return s.saveLocked(next)
+}
+
+func (s *Store) matchSubjectLocked(subjects []string, subj Subject) bool {
+	for _, ruleSubj := range subjects {
+		kind, value, _ := strings.Cut(ruleSubj, ":")
+		switch kind {
+		case SubjectFingerprint:
+			if value == subj.FP {
+				return true
+			}
+		case SubjectLabel:
+			if contains(s.state.Labels[subj.FP], value) {
+				return true
+			}
+		case SubjectPrincipal:
+			if contains(subj.Principals, value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// saveLocked writes the new state and makes it current, on failure the current state is kept.
+func (s *Store) saveLocked(next state) error {
+	rawState, err := json.Marshal(next)
+	if err != nil {
+		return fmt.Errorf("unable to marshal policies: %w", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, rawState, 0600); err != nil {
+		return fmt.Errorf("unable to write policies: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("unable to replace policies: %w", err)
+	}
+
+	s.state = next
+	return nil
+}
+
+func matchPrefix(prefixes []string, keyID string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(keyID, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,106 @@
+package policy
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	s, err := NewStore(filepath.Join(t.TempDir(), "policies.json"))
+	if err != nil {
+		t.Fatalf("unable to create store: %v", err)
+	}
+
+	return s
+}
+
+func TestAllowedDenyByDefault(t *testing.T) {
+	s := newTestStore(t)
+	subj := Subject{FP: "SHA256:machine", Principals: []string{"web"}}
+
+	if s.Allowed(subj, "prod", "db/password", AccessRead) {
+		t.Fatal("empty store allows read")
+	}
+
+	if s.Allowed(subj, "prod", "db/password", AccessWrite) {
+		t.Fatal("empty store allows write")
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.SetRule(Rule{
+		Name:      "web-db",
+		Namespace: "prod",
+		Subjects:  []string{"fp:SHA256:machine", "label:web", "principal:deploy"},
+		Prefixes:  []string{"db/"},
+		Read:      true,
+	}); err != nil {
+		t.Fatalf("unable to set rule: %v", err)
+	}
+
+	if err := s.SetLabels("SHA256:labeled", []string{"web"}); err != nil {
+		t.Fatalf("unable to set labels: %v", err)
+	}
+
+	cases := []struct {
+		name      string
+		subj      Subject
+		namespace string
+		keyID     string
+		access    Access
+		allowed   bool
+	}{
+		{"fingerprint", Subject{FP: "SHA256:machine"}, "prod", "db/password", AccessRead, true},
+		{"label", Subject{FP: "SHA256:labeled"}, "prod", "db/password", AccessRead, true},
+		{"principal", Subject{FP: "SHA256:cert", Principals: []string{"deploy"}}, "prod", "db/user", AccessRead, true},
+		{"unrelated fingerprint", Subject{FP: "SHA256:other"}, "prod", "db/password", AccessRead, false},
+		{"unrelated principal", Subject{FP: "SHA256:cert", Principals: []string{"ops"}}, "prod", "db/password", AccessRead, false},
+		{"unrelated prefix", Subject{FP: "SHA256:machine"}, "prod", "api/token", AccessRead, false},
+		{"unrelated namespace", Subject{FP: "SHA256:machine"}, "stage", "db/password", AccessRead, false},
+		{"not granted access", Subject{FP: "SHA256:machine"}, "prod", "db/password", AccessWrite, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := s.Allowed(tc.subj, tc.namespace, tc.keyID, tc.access); got != tc.allowed {
+				t.Fatalf("Allowed() = %t, want %t", got, tc.allowed)
+			}
+		})
+	}
+}
+
+func TestSetRuleKeepsStateOnSaveFailure(t *testing.T) {
+	s, err := NewStore(filepath.Join(t.TempDir(), "missing", "policies.json"))
+	if err != nil {
+		t.Fatalf("unable to create store: %v", err)
+	}
+
+	err = s.SetRule(Rule{
+		Name:      "all",
+		Namespace: "prod",
+		Subjects:  []string{"fp:SHA256:machine"},
+		Read:      true,
+	})
+	if err == nil {
+		t.Fatal("SetRule succeeded without a writable store")
+	}
+
+	if len(s.Rules()) != 0 {
+		t.Fatalf("rule is live after a failed save: %v", s.Rules())
+	}
+
+	if s.Allowed(Subject{FP: "SHA256:machine"}, "prod", "key", AccessRead) {
+		t.Fatal("failed rule grants access")
+	}
+
+	if err := s.SetLabels("SHA256:machine", []string{"web"}); err == nil {
+		t.Fatal("SetLabels succeeded without a writable store")
+	}
+
+	if len(s.Labels()) != 0 {
+		t.Fatalf("labels are live after a failed save: %v", s.Labels())
+	}
+}
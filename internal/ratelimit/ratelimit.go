@@ -0,0 +1,252 @@
+package ratelimit
+
+import (
+	"errors"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+const sweepInterval = time.Minute
+
+var (
+	ErrBanned        = errors.New("source is banned")
+	ErrSourceLimited = errors.New("source handshake rate exceeded")
+	ErrGlobalLimited = errors.New("global handshake rate exceeded")
+)
+
+type Config struct {
+	// HandshakesPerIP is the allowed handshakes per minute from a single address, zero disables the limit
+	HandshakesPerIP int
+	// HandshakesGlobal is the allowed handshakes per minute in total, zero disables the limit
+	HandshakesGlobal int
+	// AuthFailuresPerIP is the number of failed authentications within FailureWindow to ban an address
+	AuthFailuresPerIP int
+	FailureWindow     time.Duration
+	BanDuration       time.Duration
+	// Now is used as a clock when set
+	Now func() time.Time
+}
+
+type Ban struct {
+	Addr     string    `json:"addr"`
+	Until    time.Time `json:"until"`
+	Failures int       `json:"failures"`
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) take(now time.Time, perMinute int) bool {
+	if perMinute <= 0 {
+		return true
+	}
+
+	if b.last.IsZero() {
+		b.tokens = float64(perMinute)
+	} else {
+		b.tokens += now.Sub(b.last).Minutes() * float64(perMinute)
+		if b.tokens > float64(perMinute) {
+			b.tokens = float64(perMinute)
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+type source struct {
+	handshakes   bucket
+	failures     int
+	failureStart time.Time
+	bannedUntil  time.Time
+}
+
+// Limiter throttles handshakes per source address and globally, and temporary bans
+// addresses with too many failed authentications. IPv6 sources are accounted by /64,
+// as a single host usually owns the whole prefix.
+type Limiter struct {
+	mu        sync.Mutex
+	cfg       Config
+	global    bucket
+	sources   map[string]*source
+	lastSweep time.Time
+}
+
+func NewLimiter(cfg Config) *Limiter {
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+
+	return &Limiter{
+		cfg:     cfg,
+		sources: make(map[string]*source),
+	}
+}
+
+// AllowHandshake must be called before starting a handshake with the address.
+func (l *Limiter) AllowHandshake(addr string) error {
+	addr = SourceKey(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.cfg.Now()
+	l.sweepLocked(now)
+
+	src := l.sourceLocked(addr)
+	if now.Before(src.bannedUntil) {
+		return ErrBanned
+	}
+
+	if !src.handshakes.take(now, l.cfg.HandshakesPerIP) {
+		return ErrSourceLimited
+	}
+
+	if !l.global.take(now, l.cfg.HandshakesGlobal) {
+		return ErrGlobalLimited
+	}
+
+	return nil
+}
+
+// IsBanned reports whether the address is banned right now.
+func (l *Limiter) IsBanned(addr string) bool {
+	addr = SourceKey(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	src, ok := l.sources[addr]
+	return ok && l.cfg.Now().Before(src.bannedUntil)
+}
+
+// AuthFailed records failed authentication and returns true if the address got banned by it.
+func (l *Limiter) AuthFailed(addr string) bool {
+	if l.cfg.AuthFailuresPerIP <= 0 {
+		return false
+	}
+
+	addr = SourceKey(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.cfg.Now()
+	src := l.sourceLocked(addr)
+	if now.Before(src.bannedUntil) {
+		return false
+	}
+
+	if src.failureStart.IsZero() || now.Sub(src.failureStart) > l.cfg.FailureWindow {
+		src.failureStart = now
+		src.failures = 0
+	}
+
+	src.failures++
+	if src.failures < l.cfg.AuthFailuresPerIP {
+		return false
+	}
+
+	src.bannedUntil = now.Add(l.cfg.BanDuration)
+	return true
+}
+
+// Bans returns currently banned addresses.
+func (l *Limiter) Bans() []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.cfg.Now()
+	var out []Ban
+	for addr, src := range l.sources {
+		if !now.Before(src.bannedUntil) {
+			continue
+		}
+
+		out = append(out, Ban{
+			Addr:     addr,
+			Until:    src.bannedUntil,
+			Failures: src.failures,
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Addr < out[j].Addr
+	})
+	return out
+}
+
+// Unban lifts the ban and forgets failures of the address.
+func (l *Limiter) Unban(addr string) bool {
+	addr = SourceKey(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	src, ok := l.sources[addr]
+	if !ok || !l.cfg.Now().Before(src.bannedUntil) {
+		return false
+	}
+
+	src.bannedUntil = time.Time{}
+	src.failures = 0
+	src.failureStart = time.Time{}
+	return true
+}
+
+// SourceKey returns the source an address is accounted to: the address itself for IPv4
+// and its /64 prefix for IPv6. Prefixes are accepted as is.
+func SourceKey(addr string) string {
+	if prefix, err := netip.ParsePrefix(addr); err == nil {
+		return prefix.Masked().String()
+	}
+
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return addr
+	}
+
+	ip = ip.Unmap()
+	if ip.Is4() {
+		return ip.String()
+	}
+
+	return netip.PrefixFrom(ip.WithZone(""), 64).Masked().String()
+}
+
+func (l *Limiter) sourceLocked(addr string) *source {
+	src, ok := l.sources[addr]
+	if !ok {
+		src = &source{}
+		l.sources[addr] = src
+	}
+	return src
+}
+
+func (l *Limiter) sweepLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for addr, src := range l.sources {
+		if now.Before(src.bannedUntil) {
+			continue
+		}
+
+		if !src.failureStart.IsZero() && now.Sub(src.failureStart) <= l.cfg.FailureWindow {
+			continue
+		}
+
+		if !src.handshakes.last.IsZero() && now.Sub(src.handshakes.last) < time.Minute {
+			continue
+		}
+
+		delete(l.sources, addr)
+	}
+}
@@ -0,0 +1,341 @@
+package revoke
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	KindFingerprint = "fingerprint"
+	KindSerial      = "serial"
+	KindCert        = "cert"
+)
+
+// ErrNotPersistent is returned when modifying a list without a backing file,
+// such changes would be silently lost on restart.
+var ErrNotPersistent = errors.New("revocation list has no backing file configured")
+
+// List is a set of revoked keys: plain key or certificate fingerprints and certificate serials.
+// It may be backed by a file which is watched for changes and rewritten on modifications.
+type List struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	fps     map[string]struct{}
+	serials map[caSerial]struct{}
+}
+
+// caSerial is a certificate serial scoped to the signing CA like in OpenSSH KRL,
+// serials of different CAs are unrelated.
+type caSerial struct {
+	CAFingerprint string
+	Serial        uint64
+}
+
+func NewList(path string) (*List, error) {
+	l := &List{
+		path:    path,
+		fps:     make(map[string]struct{}),
+		serials: make(map[caSerial]struct{}),
+	}
+
+	if path == "" {
+		return l, nil
+	}
+
+	if _, err := l.Reload(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// IsRevoked reports whether the key is revoked, with a human-readable reason.
+// Certificates are checked by their own fingerprint, their serial and the fingerprint of the certified key.
+func (l *List) IsRevoked(pubKey ssh.PublicKey) (string, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	fp := ssh.FingerprintSHA256(pubKey)
+	if _, ok := l.fps[fp]; ok {
+		return fmt.Sprintf("fingerprint %s", fp), true
+	}
+
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return "", false
+	}
+
+	caFp := ssh.FingerprintSHA256(cert.SignatureKey)
+	if _, ok := l.serials[caSerial{CAFingerprint: caFp, Serial: cert.Serial}]; ok {
+		return fmt.Sprintf("certificate serial %d of CA %s", cert.Serial, caFp), true
+	}
+
+	keyFp := ssh.FingerprintSHA256(cert.Key)
+	if _, ok := l.fps[keyFp]; ok {
+		return fmt.Sprintf("certified key fingerprint %s", keyFp), true
+	}
+
+	return "", false
+}
+
+// Add revokes a fingerprint, a certificate serial or a whole certificate in authorized_keys format.
+// Serials are given as "<CA fingerprint> <serial>".
+func (l *List) Add(kind string, value string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.path == "" {
+		return ErrNotPersistent
+	}
+
+	if err := l.addLocked(kind, value); err != nil {
+		return err
+	}
+
+	return l.saveLocked()
+}
+
+// Remove drops a previously revoked entry.
+func (l *List) Remove(kind string, value string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.path == "" {
+		return ErrNotPersistent
+	}
+
+	switch kind {
+	case KindFingerprint:
+		if _, ok := l.fps[value]; !ok {
+			return fmt.Errorf("fingerprint %q is not revoked", value)
+		}
+		delete(l.fps, value)
+	case KindSerial:
+		serial, err := parseSerial(value)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := l.serials[serial]; !ok {
+			return fmt.Errorf("serial %d of CA %s is not revoked", serial.Serial, serial.CAFingerprint)
+		}
+		delete(l.serials, serial)
+	case KindCert:
+		fp, err := certFingerprint(value)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := l.fps[fp]; !ok {
+			return fmt.Errorf("certificate %q is not revoked", fp)
+		}
+		delete(l.fps, fp)
+	default:
+		return fmt.Errorf("unknown revocation kind: %s", kind)
+	}
+
+	return l.saveLocked()
+}
+
+// Entries returns all revoked entries in "<kind> <value>" form.
+func (l *List) Entries() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.entriesLocked()
+}
+
+// Reload re-reads the backing file if it was changed since the last load.
+func (l *List) Reload() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stat, err := os.Stat(l.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// nothing revoked yet
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to stat revocation list: %w", err)
+	}
+
+	if stat.ModTime().Equal(l.modTime) {
+		return false, nil
+	}
+
+	rawList, err := os.ReadFile(l.path)
+	if err != nil {
+		return false, fmt.Errorf("unable to read revocation list: %w", err)
+	}
+
+	fps := l.fps
+	serials := l.serials
+	l.fps = make(map[string]struct{})
+	l.serials = make(map[caSerial]struct{})
+
+	scanner := bufio.NewScanner(bytes.NewReader(rawList))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kind, value, _ := strings.Cut(line, " ")
+		if err := l.addLocked(kind, strings.TrimSpace(value)); err != nil {
+			l.fps = fps
+			l.serials = serials
+			return false, fmt.Errorf("invalid revocation list entry at line %d: %w", lineNo, err)
+		}
+	}
+
+	l.modTime = stat.ModTime()
+	return true, nil
+}
+
+// Watch polls the backing file for changes until ctx is done.
+func (l *List) Watch(ctx context.Context, interval time.Duration) {
+	if l.path == "" || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := l.Reload()
+			if err != nil {
+				log.Error().Str("path", l.path).Err(err).Msg("unable to reload revocation list")
+				continue
+			}
+
+			if changed {
+				log.Info().Str("path", l.path).Msg("revocation list reloaded")
+			}
+		}
+	}
+}
+
+func (l *List) addLocked(kind string, value string) error {
+	switch kind {
+	case KindFingerprint:
+		if !strings.HasPrefix(value, "SHA256:") {
+			return fmt.Errorf("invalid fingerprint %q: SHA256 expected", value)
+		}
+		l.fps[value] = struct{}{}
+	case KindSerial:
+		serial, err := parseSerial(value)
+		if err != nil {
+			return err
+		}
+		l.serials[serial] = struct{}{}
+	case KindCert:
+		fp, err := certFingerprint(value)
+		if err != nil {
+			return err
+		}
+		l.fps[fp] = struct{}{}
+	default:
+		return fmt.Errorf("unknown revocation kind: %s", kind)
+	}
+
+	return nil
+}
+
+func (l *List) entriesLocked() []string {
+	out := make([]string, 0, len(l.fps)+len(l.serials))
+	for fp := range l.fps {
+		out = append(out, fmt.Sprintf("%s %s", KindFingerprint, fp))
+	}
+
+	serials := make([]caSerial, 0, len(l.serials))
+	for serial := range l.serials {
+		serials = append(serials, serial)
+	}
+	sort.Slice(serials, func(i, j int) bool {
+		if serials[i].CAFingerprint != serials[j].CAFingerprint {
+			return serials[i].CAFingerprint < serials[j].CAFingerprint
+		}
+		return serials[i].Serial < serials[j].Serial
+	})
+	sort.Strings(out)
+
+	for _, serial := range serials {
+		out = append(out, fmt.Sprintf("%s %s %d", KindSerial, serial.CAFingerprint, serial.Serial))
+	}
+
+	return out
+}
+
+func (l *List) saveLocked() error {
+	if l.path == "" {
+		return ErrNotPersistent
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("# managed by lupad\n")
+	for _, entry := range l.entriesLocked() {
+		buf.WriteString(entry)
+		buf.WriteByte('\n')
+	}
+
+	tmpPath := l.path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("unable to write revocation list: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, l.path); err != nil {
+		return fmt.Errorf("unable to replace revocation list: %w", err)
+	}
+
+	if stat, err := os.Stat(l.path); err == nil {
+		l.modTime = stat.ModTime()
+	}
+	return nil
+}
+
+func parseSerial(value string) (caSerial, error) {
+	caFp, rawSerial, ok := strings.Cut(value, " ")
+	if !ok || !strings.HasPrefix(caFp, "SHA256:") {
+		return caSerial{}, fmt.Errorf("invalid serial %q: \"<CA SHA256 fingerprint> <serial>\" expected", value)
+	}
+
+	serial, err := strconv.ParseUint(strings.TrimSpace(rawSerial), 10, 64)
+	if err != nil {
+		return caSerial{}, fmt.Errorf("invalid serial %q: %w", value, err)
+	}
+
+	return caSerial{CAFingerprint: caFp, Serial: serial}, nil
+}
+
+func certFingerprint(authorizedKey string) (string, error) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return "", fmt.Errorf("invalid certificate: %w", err)
+	}
+
+	if _, ok := pubKey.(*ssh.Certificate); !ok {
+		return "", errors.New("invalid certificate: not a certificate")
+	}
+
+	return ssh.FingerprintSHA256(pubKey), nil
+}
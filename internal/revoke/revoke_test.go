@@ -0,0 +1,66 @@
+package revoke
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("unable to create public key: %v", err)
+	}
+
+	return key
+}
+
+func TestRevocationSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked_keys")
+	key := newTestKey(t)
+
+	list, err := NewList(path)
+	if err != nil {
+		t.Fatalf("unable to open revocation list: %v", err)
+	}
+
+	if err := list.Add(KindFingerprint, ssh.FingerprintSHA256(key)); err != nil {
+		t.Fatalf("unable to revoke key: %v", err)
+	}
+
+	reopened, err := NewList(path)
+	if err != nil {
+		t.Fatalf("unable to reopen revocation list: %v", err)
+	}
+
+	if _, revoked := reopened.IsRevoked(key); !revoked {
+		t.Fatal("revoked key accepted after reopen")
+	}
+}
+
+func TestModifyWithoutPath(t *testing.T) {
+	list, err := NewList("")
+	if err != nil {
+		t.Fatalf("unable to create revocation list: %v", err)
+	}
+
+	fp := ssh.FingerprintSHA256(newTestKey(t))
+	if err := list.Add(KindFingerprint, fp); !errors.Is(err, ErrNotPersistent) {
+		t.Fatalf("expected ErrNotPersistent on add, got %v", err)
+	}
+
+	if err := list.Remove(KindFingerprint, fp); !errors.Is(err, ErrNotPersistent) {
+		t.Fatalf("expected ErrNotPersistent on remove, got %v", err)
+	}
+}
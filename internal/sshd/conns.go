@@ -0,0 +1,250 @@
+package sshd
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/buglloc/lupa/internal/metrics"
+	"github.com/buglloc/lupa/internal/ratelimit"
+)
+
+var (
+	errShuttingDown      = errors.New("server is shutting down")
+	errTooManyConns      = errors.New("too many connections")
+	errTooManyConnsPerIP = errors.New("too many connections from source")
+)
+
+// trackedConn is a live connection, sshConn is nil while handshaking and channel is nil while idle.
+type trackedConn struct {
+	netConn       net.Conn
+	sourceAddr    string
+	sshConn       *ssh.ServerConn
+	channel       *drainChannel
+	timersMu      sync.Mutex
+	idleTimeout   time.Duration
+	idleTimer     *time.Timer
+	lifetimeTimer *time.Timer
+}
+
+func (c *trackedConn) Close() error {
+	if c.sshConn != nil {
+		return c.sshConn.Close()
+	}
+	return c.netConn.Close()
+}
+
+// setBusy pauses the idle timer while a request is in flight. The timer is per connection,
+// which is per channel as well since handleChannels serves channels one at a time.
+func (c *trackedConn) setBusy(busy bool) {
+	c.timersMu.Lock()
+	defer c.timersMu.Unlock()
+
+	if c.idleTimer == nil {
+		return
+	}
+
+	if busy {
+		c.idleTimer.Stop()
+		return
+	}
+
+	c.idleTimer.Reset(c.idleTimeout)
+}
+
+func (c *trackedConn) startTimers(idleTimeout time.Duration, lifetime time.Duration) {
+	c.timersMu.Lock()
+	defer c.timersMu.Unlock()
+
+	if idleTimeout > 0 {
+		c.idleTimeout = idleTimeout
+		c.idleTimer = time.AfterFunc(idleTimeout, func() {
+			log.Info().
+				Str("remote_addr", c.netConn.RemoteAddr().String()).
+				Dur("idle_timeout", idleTimeout).
+				Msg("idle timeout exceeded, closing connection")
+			_ = c.netConn.Close()
+		})
+	}
+
+	if lifetime > 0 {
+		c.lifetimeTimer = time.AfterFunc(lifetime, func() {
+			log.Info().
+				Str("remote_addr", c.netConn.RemoteAddr().String()).
+				Dur("max_lifetime", lifetime).
+				Msg("connection lifetime exceeded, closing connection")
+			_ = c.netConn.Close()
+		})
+	}
+}
+
+func (c *trackedConn) stopTimers() {
+	c.timersMu.Lock()
+	defer c.timersMu.Unlock()
+
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+
+	if c.lifetimeTimer != nil {
+		c.lifetimeTimer.Stop()
+	}
+}
+
+// drainChannel tracks whether a lupa request is being read or processed,
+// so it can be closed between requests without cutting one in flight.
+type drainChannel struct {
+	ssh.Channel
+	onBusy   func(bool)
+	mu       sync.Mutex
+	busy     bool
+	draining bool
+}
+
+func (c *drainChannel) Read(data []byte) (int, error) {
+	c.mu.Lock()
+	closed := c.draining && !c.busy
+	c.mu.Unlock()
+	if closed {
+		return 0, io.EOF
+	}
+
+	n, err := c.Channel.Read(data)
+	if n == 0 {
+		return n, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.busy {
+		return n, err
+	}
+
+	if c.draining {
+		// the request was read after drain closed the idle channel, its response couldn't be sent,
+		// so it must not be processed at all
+		return 0, io.EOF
+	}
+
+	c.busy = true
+	c.onBusy(true)
+	return n, err
+}
+
+// idle marks the end of request processing, returns true when the channel must be closed.
+func (c *drainChannel) idle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.busy = false
+	c.onBusy(false)
+	return c.draining
+}
+
+// drain closes the channel now if no request is in flight, otherwise once it is finished.
+func (c *drainChannel) drain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.draining = true
+	if !c.busy {
+		_ = c.Channel.Close()
+	}
+}
+
+func (s *Server) trackConn(conn net.Conn) (*trackedConn, error) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	if s.isShuttingDown() {
+		return nil, errShuttingDown
+	}
+
+	if s.limits.MaxConnections > 0 && len(s.conns) >= s.limits.MaxConnections {
+		return nil, errTooManyConns
+	}
+
+	sourceAddr := ratelimit.SourceKey(remoteHost(conn.RemoteAddr()))
+	if s.limits.MaxConnectionsPerIP > 0 && s.connsPerIP[sourceAddr] >= s.limits.MaxConnectionsPerIP {
+		return nil, errTooManyConnsPerIP
+	}
+
+	tc := &trackedConn{
+		netConn:    conn,
+		sourceAddr: sourceAddr,
+	}
+	tc.startTimers(s.limits.IdleTimeout, s.limits.MaxLifetime)
+
+	s.conns[tc] = struct{}{}
+	s.connsPerIP[sourceAddr]++
+	s.connsWg.Add(1)
+	metrics.ConnectionsTotal.Inc()
+	metrics.ConnectionsActive.Inc()
+	return tc, nil
+}
+
+func (s *Server) untrackConn(tc *trackedConn) {
+	tc.stopTimers()
+
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	delete(s.conns, tc)
+	s.connsPerIP[tc.sourceAddr]--
+	if s.connsPerIP[tc.sourceAddr] <= 0 {
+		delete(s.connsPerIP, tc.sourceAddr)
+	}
+	s.connsWg.Done()
+	metrics.ConnectionsActive.Dec()
+}
+
+// setConnState updates the connection state, returns false when the server is shutting down.
+func (s *Server) setConnState(tc *trackedConn, sshConn *ssh.ServerConn, channel *drainChannel) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	tc.sshConn = sshConn
+	tc.channel = channel
+	return !s.isShuttingDown()
+}
+
+// drainConns closes idle connections and asks busy ones to stop after the current request.
+func (s *Server) drainConns() {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	for tc := range s.conns {
+		if tc.channel == nil {
+			_ = tc.Close()
+			continue
+		}
+
+		tc.channel.drain()
+	}
+}
+
+// closeConns force-closes all the connections left.
+func (s *Server) closeConns() int {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	for tc := range s.conns {
+		_ = tc.Close()
+	}
+	return len(s.conns)
+}
+
+func (s *Server) isShuttingDown() bool {
+	select {
+	case <-s.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
@@ -3,8 +3,9 @@ package sshd
 import "golang.org/x/crypto/ssh"
 
 const (
-	ExtensionPubFp = "pub-fp"
-	ExtensionRole  = "role"
+	ExtensionPubFp      = "pub-fp"
+	ExtensionRole       = "role"
+	ExtensionPrincipals = "principals"
 )
 
 type HandlerFn func(conn *ssh.ServerConn, req interface{}) (interface{}, error)
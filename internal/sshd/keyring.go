@@ -0,0 +1,165 @@
+package sshd
+
+import (
+	"errors"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/buglloc/lupa/internal/config"
+	"github.com/buglloc/lupa/internal/metrics"
+)
+
+// keyring is the reloadable part of the server configuration: host keys and trusted user CAs.
+type keyring struct {
+	sshConf    *ssh.ServerConfig
+	hostKeys   int
+	trustedCAs map[string]struct{}
+}
+
+func (s *Server) newKeyring(cfg *config.SSH) (*keyring, error) {
+	out := &keyring{
+		trustedCAs: make(map[string]struct{}, len(cfg.TrustedUserCAs)),
+	}
+
+	for _, caFp := range cfg.TrustedUserCAs {
+		out.trustedCAs[caFp] = struct{}{}
+	}
+
+	out.sshConf = &ssh.ServerConfig{
+		MaxAuthTries:      cfg.MaxAuthTries,
+		ServerVersion:     "SSH-2.0-Lupad",
+		PublicKeyCallback: s.publicKeyCallback,
+		AuthLogCallback:   s.authLogCallback,
+	}
+
+	for _, keyPath := range cfg.HostKeys {
+		rawKey, err := os.ReadFile(keyPath)
+		if err != nil {
+			log.Info().Str("key_path", keyPath).Err(err).Msg("ignore host key")
+			continue
+		}
+
+		key, err := ssh.ParsePrivateKey(rawKey)
+		if err != nil {
+			log.Warn().Str("key_path", keyPath).Err(err).Msg("skip malformed host key")
+			continue
+		}
+
+		out.sshConf.AddHostKey(key)
+		out.hostKeys++
+
+		// the host certificate is presented along with the key if issued next to it, like ssh-keygen -s does
+		certPath := keyPath + "-cert.pub"
+		if _, err := os.Stat(certPath); err != nil {
+			continue
+		}
+
+		certSigner, err := loadHostCert(certPath, key)
+		if err != nil {
+			log.Warn().Str("cert_path", certPath).Err(err).Msg("skip malformed host certificate")
+			continue
+		}
+
+		out.sshConf.AddHostKey(certSigner)
+	}
+
+	if out.hostKeys == 0 {
+		return nil, errors.New("no host keys found")
+	}
+
+	return out, nil
+}
+
+// Reload swaps host keys, trusted user CAs and auth settings, established connections are kept.
+// Listen address, rate limits and connection limits require a restart.
+func (s *Server) Reload(cfg *config.SSH) error {
+	keys, err := s.newKeyring(cfg)
+	if err != nil {
+		return err
+	}
+
+	s.keysMu.Lock()
+	s.keys = keys
+	s.keysMu.Unlock()
+	return nil
+}
+
+// loadHostCert returns a signer presenting the host certificate of the key.
+func loadHostCert(certPath string, key ssh.Signer) (ssh.Signer, error) {
+	rawCert, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(rawCert)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("not a certificate")
+	}
+
+	if cert.CertType != ssh.HostCert {
+		return nil, errors.New("not a host certificate")
+	}
+
+	return ssh.NewCertSigner(cert, key)
+}
+
+// ValidateHostCert checks the host certificate issued for the key.
+func ValidateHostCert(certPath string, key ssh.Signer) error {
+	_, err := loadHostCert(certPath, key)
+	return err
+}
+
+func (s *Server) currentKeys() *keyring {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+
+	return s.keys
+}
+
+func (s *Server) authLogCallback(sshConn ssh.ConnMetadata, method string, err error) {
+	if method == "none" {
+		// huh
+		return
+	}
+
+	if err != nil {
+		metrics.AuthTotal.Inc(authMethodLabel(method), "failure")
+		log.Warn().
+			Str("remote_addr", sshConn.RemoteAddr().String()).
+			Str("session_id", newSessID(sshConn.SessionID())).
+			Str("auth_method", method).
+			Str("user", sshConn.User()).
+			Err(err).Msg("auth failed")
+
+		// rejected keys are usual for clients offering several ones, so the ban counts
+		// connections which end up unauthenticated, see acceptConnection
+		s.authFailures.Store(sshConn.RemoteAddr().String(), struct{}{})
+		return
+	}
+
+	metrics.AuthTotal.Inc(authMethodLabel(method), "success")
+	log.Warn().
+		Str("remote_addr", sshConn.RemoteAddr().String()).
+		Str("session_id", newSessID(sshConn.SessionID())).
+		Str("auth_method", method).
+		Str("user", sshConn.User()).
+		Msg("user authenticated")
+}
+
+// authMethodLabel maps the client supplied auth method to a fixed set of metric labels,
+// unknown methods are passed through by x/crypto and must not create new series.
+func authMethodLabel(method string) string {
+	switch method {
+	case "none", "password", "publickey", "keyboard-interactive":
+		return method
+	default:
+		return "other"
+	}
+}
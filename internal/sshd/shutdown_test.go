@@ -0,0 +1,195 @@
+package sshd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/buglloc/lupa/internal/config"
+	"github.com/buglloc/lupa/pkg/lupa"
+)
+
+func newTestSigner(t *testing.T) (ssh.Signer, ed25519.PrivateKey) {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("unable to create signer: %v", err)
+	}
+
+	return signer, priv
+}
+
+// startTestServer runs a server with a ping handler blocking until release is closed,
+// started receives a value once the handler is called.
+func startTestServer(t *testing.T, started chan<- struct{}, release <-chan struct{}) (*Server, string) {
+	t.Helper()
+
+	_, hostKey := newTestSigner(t)
+	pemKey, err := ssh.MarshalPrivateKey(hostKey, "")
+	if err != nil {
+		t.Fatalf("unable to marshal host key: %v", err)
+	}
+
+	hostKeyPath := filepath.Join(t.TempDir(), "ssh_host_ed25519_key")
+	if err := os.WriteFile(hostKeyPath, pem.EncodeToMemory(pemKey), 0600); err != nil {
+		t.Fatalf("unable to write host key: %v", err)
+	}
+
+	srv, err := NewServer(&Config{
+		SSH: config.SSH{
+			Addr:     "127.0.0.1:0",
+			HostKeys: []string{hostKeyPath},
+		},
+		CheckUserKey: func(_ ssh.ConnMetadata, _ ssh.PublicKey) (string, error) {
+			return "user", nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unable to create server: %v", err)
+	}
+
+	srv.AddHandler("ping", func(_ *ssh.ServerConn, msg interface{}) (interface{}, error) {
+		req, ok := msg.(*lupa.PingReqMsg)
+		if !ok {
+			return nil, errors.New("unexpected request type")
+		}
+
+		started <- struct{}{}
+		<-release
+		return &lupa.PingRspMsg{Nonce: req.Nonce}, nil
+	})
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		srv.connsMu.Lock()
+		listener := srv.listener
+		srv.connsMu.Unlock()
+		if listener != nil {
+			return srv, listener.Addr().String()
+		}
+
+		select {
+		case err := <-served:
+			t.Fatalf("server stopped: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	t.Fatal("server is not listening")
+	return nil, ""
+}
+
+func dialTestServer(t *testing.T, addr string) *lupa.Client {
+	t.Helper()
+
+	signer, _ := newTestSigner(t)
+	sshc, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	t.Cleanup(func() { _ = sshc.Close() })
+
+	client, err := lupa.NewClient(sshc)
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+
+	return client
+}
+
+func TestShutdownDrainsInFlightRequest(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv, addr := startTestServer(t, started, release)
+	client := dialTestServer(t, addr)
+
+	pinged := make(chan error, 1)
+	go func() {
+		_, err := client.Ping()
+		pinged <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown finished with a request in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-pinged; err != nil {
+		t.Fatalf("in-flight request failed: %v", err)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	if _, err := client.Ping(); err == nil {
+		t.Fatal("request succeeded after shutdown")
+	}
+}
+
+func TestShutdownForceClosesAfterDeadline(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+
+	srv, addr := startTestServer(t, started, release)
+	client := dialTestServer(t, addr)
+
+	pinged := make(chan error, 1)
+	go func() {
+		_, err := client.Ping()
+		pinged <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	select {
+	case err := <-pinged:
+		if err == nil {
+			t.Fatal("request stuck past the deadline succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed after the deadline")
+	}
+}
@@ -7,89 +7,76 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"os"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/ssh"
 
 	"github.com/buglloc/lupa/internal/config"
+	"github.com/buglloc/lupa/internal/metrics"
+	"github.com/buglloc/lupa/internal/ratelimit"
 	"github.com/buglloc/lupa/pkg/lupa"
 )
 
 type Config struct {
 	config.SSH
-	CheckUserKey func(user string, pubKey ssh.PublicKey) (string, error)
+	CheckUserKey    func(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (string, error)
+	OnAuthenticated func(conn *ssh.ServerConn) error
+	OnRequest       func(conn *ssh.ServerConn, typ string, req interface{}, rsp interface{}, err error)
 }
 
 type Server struct {
 	addr       string
 	listener   net.Listener
-	sshConf    ssh.ServerConfig
+	keysMu     sync.RWMutex
+	keys       *keyring
 	handlers   map[string]HandlerFn
-	checkKeyFn func(user string, pubKey ssh.PublicKey) (string, error)
+	limiter    *ratelimit.Limiter
+	banDur     time.Duration
+	checkKeyFn func(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (string, error)
+	onAuthFn   func(conn *ssh.ServerConn) error
+	onReqFn    func(conn *ssh.ServerConn, typ string, req interface{}, rsp interface{}, err error)
 	closed     chan struct{}
+	connsMu    sync.Mutex
+	conns      map[*trackedConn]struct{}
+	connsPerIP map[string]int
+	limits     config.Limits
+	connsWg    sync.WaitGroup
 	ctx        context.Context
 	shutdownFn context.CancelFunc
+
+	// authFailures holds remote addresses of handshaking connections with rejected auth attempts
+	authFailures sync.Map
 }
 
 func NewServer(cfg *Config) (*Server, error) {
 	srv := &Server{
-		addr:       cfg.Addr,
-		handlers:   make(map[string]HandlerFn),
+		addr:     cfg.Addr,
+		handlers: make(map[string]HandlerFn),
+		limiter: ratelimit.NewLimiter(ratelimit.Config{
+			HandshakesPerIP:   cfg.RateLimit.HandshakesPerIP,
+			HandshakesGlobal:  cfg.RateLimit.HandshakesGlobal,
+			AuthFailuresPerIP: cfg.RateLimit.AuthFailuresPerIP,
+			FailureWindow:     cfg.RateLimit.FailureWindow,
+			BanDuration:       cfg.RateLimit.BanDuration,
+		}),
+		banDur:     cfg.RateLimit.BanDuration,
 		checkKeyFn: cfg.CheckUserKey,
+		onAuthFn:   cfg.OnAuthenticated,
+		onReqFn:    cfg.OnRequest,
 		closed:     make(chan struct{}),
+		conns:      make(map[*trackedConn]struct{}),
+		connsPerIP: make(map[string]int),
+		limits:     cfg.Limits,
 	}
 
-	srv.sshConf = ssh.ServerConfig{
-		MaxAuthTries:      -1,
-		ServerVersion:     "SSH-2.0-Lupad",
-		PublicKeyCallback: srv.publicKeyCallback,
-		AuthLogCallback: func(sshConn ssh.ConnMetadata, method string, err error) {
-			if method == "none" {
-				// huh
-				return
-			}
-
-			if err != nil {
-				log.Warn().
-					Str("remote_addr", sshConn.RemoteAddr().String()).
-					Str("session_id", newSessID(sshConn.SessionID())).
-					Str("auth_method", method).
-					Str("user", sshConn.User()).
-					Err(err).Msg("auth failed")
-				return
-			}
-
-			log.Warn().
-				Str("remote_addr", sshConn.RemoteAddr().String()).
-				Str("session_id", newSessID(sshConn.SessionID())).
-				Str("auth_method", method).
-				Str("user", sshConn.User()).
-				Msg("user authenticated")
-		},
-	}
-
-	haveKey := false
-	for _, keyPath := range cfg.HostKeys {
-		rawKey, err := os.ReadFile(keyPath)
-		if err != nil {
-			log.Info().Str("key_path", keyPath).Err(err).Msg("ignore host key")
-			continue
-		}
-
-		key, err := ssh.ParsePrivateKey(rawKey)
-		if err != nil {
-			log.Warn().Str("key_path", keyPath).Err(err).Msg("skip malformed host key")
-			continue
-		}
-
-		srv.sshConf.AddHostKey(key)
-		haveKey = true
-	}
-
-	if !haveKey {
-		return nil, errors.New("no host keys found")
+	var err error
+	srv.keys, err = srv.newKeyring(&cfg.SSH)
+	if err != nil {
+		return nil, err
 	}
 
 	srv.ctx, srv.shutdownFn = context.WithCancel(context.Background())
@@ -104,7 +91,15 @@ func (s *Server) ListenAndServe() error {
 		return fmt.Errorf("failed to listen: %w", err)
 	}
 
+	s.connsMu.Lock()
 	s.listener = listener
+	shuttingDown := s.isShuttingDown()
+	s.connsMu.Unlock()
+	if shuttingDown {
+		_ = listener.Close()
+		return nil
+	}
+
 	log.Info().
 		Str("addr", s.addr).
 		Msg("listening")
@@ -120,12 +115,46 @@ func (s *Server) ListenAndServe() error {
 			continue
 		}
 
+		if err := s.limiter.AllowHandshake(remoteHost(tcpConn.RemoteAddr())); err != nil {
+			// debug level only: throttled sources must not be able to flood logs
+			log.Debug().
+				Str("remote_addr", tcpConn.RemoteAddr().String()).
+				Err(err).
+				Msg("connection throttled")
+			_ = tcpConn.Close()
+			continue
+		}
+
 		go s.acceptConnection(tcpConn)
 	}
 }
 
+// Shutdown stops accepting connections and channels, lets in-flight requests finish
+// and force-closes connections left when ctx is done.
 func (s *Server) Shutdown(ctx context.Context) error {
-	_ = s.listener.Close()
+	s.connsMu.Lock()
+	s.shutdownFn()
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	s.connsMu.Unlock()
+
+	s.drainConns()
+
+	drained := make(chan struct{})
+	go func() {
+		s.connsWg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		log.Warn().
+			Int("connections", s.closeConns()).
+			Msg("shutdown deadline exceeded, connections closed forcibly")
+		return ctx.Err()
+	}
 
 	select {
 	case <-ctx.Done():
@@ -139,29 +168,127 @@ func (s *Server) AddHandler(name string, fn HandlerFn) {
 	s.handlers[name] = fn
 }
 
+// HostKeys returns the number of loaded host keys.
+func (s *Server) HostKeys() int {
+	return s.currentKeys().hostKeys
+}
+
+// Listening reports whether the server accepts new connections.
+func (s *Server) Listening() bool {
+	select {
+	case <-s.closed:
+		return false
+	default:
+	}
+
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	return s.listener != nil && !s.isShuttingDown()
+}
+
+// Bans returns currently banned source addresses.
+func (s *Server) Bans() []ratelimit.Ban {
+	return s.limiter.Bans()
+}
+
+// Unban lifts the ban of the source address.
+func (s *Server) Unban(addr string) bool {
+	return s.limiter.Unban(addr)
+}
+
 func (s *Server) publicKeyCallback(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
 	if s.checkKeyFn == nil {
 		return nil, errors.New("CheckUserKey handler is not configured")
 	}
 
-	role, err := s.checkKeyFn(conn.User(), pubKey)
+	if s.limiter.IsBanned(remoteHost(conn.RemoteAddr())) {
+		return nil, ratelimit.ErrBanned
+	}
+
+	role, err := s.checkKeyFn(conn, pubKey)
 	if err != nil {
 		return nil, err
 	}
 
-	return &ssh.Permissions{
+	perms := &ssh.Permissions{
 		Extensions: map[string]string{
 			ExtensionPubFp: ssh.FingerprintSHA256(pubKey),
 			ExtensionRole:  role,
 		},
-	}, nil
+	}
+
+	if principals := s.certPrincipals(pubKey); len(principals) > 0 {
+		perms.Extensions[ExtensionPrincipals] = strings.Join(principals, ",")
+	}
+
+	return perms, nil
+}
+
+// certPrincipals returns principals of a valid user certificate signed by one of trusted CAs
+func (s *Server) certPrincipals(pubKey ssh.PublicKey) []string {
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.UserCert || len(cert.ValidPrincipals) == 0 {
+		return nil
+	}
+
+	caFp := ssh.FingerprintSHA256(cert.SignatureKey)
+	if _, ok := s.currentKeys().trustedCAs[caFp]; !ok {
+		return nil
+	}
+
+	var checker ssh.CertChecker
+	if err := checker.CheckCert(cert.ValidPrincipals[0], cert); err != nil {
+		log.Warn().
+			Str("ca_fp", caFp).
+			Uint64("serial", cert.Serial).
+			Err(err).
+			Msg("ignore principals of invalid certificate")
+		return nil
+	}
+
+	return cert.ValidPrincipals
 }
 
 // Accept a single connection - run in a go routine as the ssh authentication can block
 func (s *Server) acceptConnection(conn net.Conn) {
-	sshConn, chans, reqs, err := ssh.NewServerConn(conn, &s.sshConf)
+	tc, err := s.trackConn(conn)
+	if err != nil {
+		if !errors.Is(err, errShuttingDown) {
+			log.Warn().
+				Str("remote_addr", conn.RemoteAddr().String()).
+				Err(err).
+				Msg("connection limit exceeded")
+		}
+		_ = conn.Close()
+		return
+	}
+	defer s.untrackConn(tc)
+
+	if s.limits.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.limits.HandshakeTimeout))
+	}
+
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.currentKeys().sshConf)
+	_, authFailed := s.authFailures.LoadAndDelete(conn.RemoteAddr().String())
+	if err != nil && authFailed {
+		sourceAddr := remoteHost(conn.RemoteAddr())
+		if s.limiter.AuthFailed(sourceAddr) {
+			log.Warn().
+				Str("source_addr", ratelimit.SourceKey(sourceAddr)).
+				Dur("ban_duration", s.banDur).
+				Msg("source banned: too many auth failures")
+		}
+	}
+
 	if err != nil {
+		var netErr net.Error
 		switch {
+		case errors.As(err, &netErr) && netErr.Timeout():
+			log.Info().
+				Str("remote_addr", conn.RemoteAddr().String()).
+				Dur("handshake_timeout", s.limits.HandshakeTimeout).
+				Msg("handshake timeout exceeded")
 		case errors.Is(err, io.EOF):
 		case strings.Contains(strings.ToLower(err.Error()), "connection reset by peer"):
 		default:
@@ -170,13 +297,33 @@ func (s *Server) acceptConnection(conn net.Conn) {
 		return
 	}
 
+	if s.onAuthFn != nil {
+		if err := s.onAuthFn(sshConn); err != nil {
+			log.Warn().
+				Str("remote_addr", sshConn.RemoteAddr().String()).
+				Str("session_id", newSessID(sshConn.SessionID())).
+				Str("user", sshConn.User()).
+				Err(err).Msg("connection rejected")
+			_ = sshConn.Close()
+			return
+		}
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	if !s.setConnState(tc, sshConn, nil) {
+		_ = sshConn.Close()
+		return
+	}
+
 	// Discard all global out-of-band Requests
 	go ssh.DiscardRequests(reqs)
 	// Accept all channels
-	go s.handleChannels(sshConn, chans)
+	s.handleChannels(tc, sshConn, chans)
 }
 
-func (s *Server) handleChannels(sshConn *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+func (s *Server) handleChannels(tc *trackedConn, sshConn *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+	defer func() { _ = sshConn.Close() }()
+
 	logger := log.With().
 		Str("remote_addr", sshConn.RemoteAddr().String()).
 		Str("session_id", newSessID(sshConn.SessionID())).
@@ -184,22 +331,37 @@ func (s *Server) handleChannels(sshConn *ssh.ServerConn, chans <-chan ssh.NewCha
 		Logger()
 
 	for newChannel := range chans {
+		if s.isShuttingDown() {
+			_ = newChannel.Reject(ssh.ResourceShortage, "server is shutting down")
+			return
+		}
+
 		if newChannel.ChannelType() != lupa.ChannelType {
 			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
 			continue
 		}
 
 		func() {
-			channel, reqs, err := newChannel.Accept()
+			sshChannel, reqs, err := newChannel.Accept()
 			if err != nil {
 				logger.Warn().Err(err).Msg("unable to accept lupa channel")
 				return
 			}
+
+			channel := &drainChannel{
+				Channel: sshChannel,
+				onBusy:  tc.setBusy,
+			}
 			defer func() { _ = channel.Close() }()
 
 			// Discard all global out-of-band Requests
 			go ssh.DiscardRequests(reqs)
 
+			if !s.setConnState(tc, sshConn, channel) {
+				return
+			}
+			defer s.setConnState(tc, sshConn, nil)
+
 			lupaChan := lupa.NewChannel(channel)
 			for {
 				err := lupaChan.ProcessRequest(func(typ string, msg interface{}) (interface{}, error) {
@@ -216,18 +378,65 @@ func (s *Server) handleChannels(sshConn *ssh.ServerConn, chans <-chan ssh.NewCha
 					logger.Warn().Err(err).Msg("unable to process channel requests")
 					break
 				}
+
+				if channel.idle() {
+					logger.Info().Msg("channel drained")
+					break
+				}
 			}
 		}()
+
+		if s.isShuttingDown() {
+			return
+		}
 	}
 }
 
-func (s *Server) handleReq(conn *ssh.ServerConn, typ string, msg interface{}) (interface{}, error) {
+func (s *Server) handleReq(conn *ssh.ServerConn, typ string, msg interface{}) (rsp interface{}, err error) {
+	if s.onReqFn != nil {
+		defer func() {
+			s.onReqFn(conn, typ, msg, rsp, err)
+		}()
+	}
+
 	handler, ok := s.handlers[typ]
 	if !ok {
+		metrics.RequestsTotal.Inc("unknown", "error")
 		return nil, fmt.Errorf("unsupported request: %s", typ)
 	}
 
-	return handler(conn, msg)
+	// a bug in a single handler must not take the whole server down
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error().
+				Str("req_type", typ).
+				Interface("panic", r).
+				Str("stack", string(debug.Stack())).
+				Msg("request handler panicked")
+
+			metrics.RequestsTotal.Inc(typ, "error")
+			rsp, err = nil, fmt.Errorf("unable to process %s request: internal error", typ)
+		}
+	}()
+
+	start := time.Now()
+	rsp, err = handler(conn, msg)
+	metrics.RequestDuration.Observe(time.Since(start).Seconds(), typ)
+	if err != nil {
+		metrics.RequestsTotal.Inc(typ, "error")
+	} else {
+		metrics.RequestsTotal.Inc(typ, "ok")
+	}
+
+	return rsp, err
+}
+
+func remoteHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
 }
 
 func newSessID(sshSessionID []byte) string {
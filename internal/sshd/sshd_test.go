@@ -0,0 +1,28 @@
+package sshd
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHandlerPanicIsRecovered(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	close(release)
+
+	srv, addr := startTestServer(t, started, release)
+	srv.AddHandler("panic", func(_ *ssh.ServerConn, _ interface{}) (interface{}, error) {
+		var keys []string
+		return keys[len(keys)-1], nil
+	})
+
+	if _, err := srv.handleReq(nil, "panic", nil); err == nil {
+		t.Fatal("panicked request succeeded")
+	}
+
+	client := dialTestServer(t, addr)
+	if _, err := client.Ping(); err != nil {
+		t.Fatalf("server is gone after a panic: %v", err)
+	}
+}
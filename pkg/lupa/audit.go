@@ -0,0 +1,35 @@
+package lupa
+
+import "time"
+
+// AuditQuery selects audit records, zero fields match everything.
+type AuditQuery struct {
+	MachineFP string
+	KeyID     string
+	Type      string
+	Outcome   string
+	Since     time.Time
+	Until     time.Time
+	// Cursor is the sequence number after which records are returned.
+	Cursor uint64
+	// Limit of records per page, server may return less.
+	Limit uint32
+}
+
+// AuditRecord is a single audit log entry.
+type AuditRecord struct {
+	Seq        uint64            `json:"seq"`
+	Time       time.Time         `json:"time"`
+	SessionID  string            `json:"session_id,omitempty"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	User       string            `json:"user,omitempty"`
+	MachineFP  string            `json:"machine_fp,omitempty"`
+	Role       string            `json:"role,omitempty"`
+	Type       string            `json:"type"`
+	KeyID      string            `json:"key_id,omitempty"`
+	Outcome    string            `json:"outcome"`
+	Error      string            `json:"error,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+	PrevHash   string            `json:"prev_hash"`
+	Hash       string            `json:"hash"`
+}
@@ -0,0 +1,10 @@
+package lupa
+
+import "time"
+
+// Ban is a source address temporary banned for too many failed auth attempts.
+type Ban struct {
+	Addr     string    `json:"addr"`
+	Until    time.Time `json:"until"`
+	Failures int       `json:"failures"`
+}
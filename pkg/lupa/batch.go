@@ -0,0 +1,169 @@
+package lupa
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	BatchOpGet    = "get"
+	BatchOpPut    = "put"
+	BatchOpDelete = "delete"
+)
+
+// PutItem is a single value of PutMany.
+// Either ExpiresAt or TTL, counted by the server from the time of put, makes the value expire.
+// MaxReads limits the number of reads, the value is deleted after the last one.
+type PutItem struct {
+	Name      string        `json:"name"`
+	Data      []byte        `json:"data"`
+	ExpiresAt *time.Time    `json:"expires_at,omitempty"`
+	TTL       time.Duration `json:"ttl,omitempty"`
+	MaxReads  uint32        `json:"max_reads,omitempty"`
+}
+
+// BatchOp is a single operation of a batch request.
+type BatchOp struct {
+	Op    string `json:"op"`
+	KeyID string `json:"key_id,omitempty"`
+	Data  []byte `json:"data,omitempty"`
+	// ExpectedRev makes put and delete conditional on the current key revision,
+	// zero revision means the key must not exist.
+	ExpectedRev *uint64 `json:"expected_rev,omitempty"`
+	// ExpiresAt, TTL and MaxReads limit the put value lifetime, see PutItem.
+	ExpiresAt *time.Time    `json:"expires_at,omitempty"`
+	TTL       time.Duration `json:"ttl,omitempty"`
+	MaxReads  uint32        `json:"max_reads,omitempty"`
+}
+
+// BatchResult is a result of a single batch operation.
+// Rev is the key revision read by get or written by put.
+type BatchResult struct {
+	KeyID string `json:"key_id"`
+	Data  []byte `json:"data,omitempty"`
+	Rev   uint64 `json:"rev,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// BatchRsp is a batch response, results are in the order of operations.
+type BatchRsp struct {
+	Applied bool          `json:"applied"`
+	Results []BatchResult `json:"results"`
+}
+
+// BatchError is returned when the batch was not applied, Results tell which operations failed.
+type BatchError struct {
+	Results []BatchResult
+}
+
+func (e *BatchError) Error() string {
+	var errs []string
+	for _, r := range e.Results {
+		if r.Error != "" {
+			errs = append(errs, fmt.Sprintf("%s: %s", r.KeyID, r.Error))
+		}
+	}
+
+	return fmt.Sprintf("batch was not applied: %s", strings.Join(errs, "; "))
+}
+
+// Batch collects operations applied by the server atomically: either all of them or none.
+//
+//	results, err := client.Batch().
+//		Put("", []byte("user")).
+//		Put("", []byte("password")).
+//		Delete(oldKeyID).
+//		Commit()
+type Batch struct {
+	c         *Client
+	namespace string
+	ops       []BatchOp
+}
+
+// Batch starts a new batch on the machine keys.
+func (c *Client) Batch() *Batch {
+	return &Batch{
+		c: c,
+	}
+}
+
+// Namespace switches the batch to keys of the shared namespace, key IDs are key names within it.
+func (b *Batch) Namespace(namespace string) *Batch {
+	b.namespace = namespace
+	return b
+}
+
+func (b *Batch) Get(keyID string) *Batch {
+	return b.add(BatchOp{Op: BatchOpGet, KeyID: keyID})
+}
+
+// Put stores the value, empty keyID means a new random one.
+func (b *Batch) Put(keyID string, data []byte) *Batch {
+	return b.add(BatchOp{Op: BatchOpPut, KeyID: keyID, Data: data})
+}
+
+func (b *Batch) Delete(keyID string) *Batch {
+	return b.add(BatchOp{Op: BatchOpDelete, KeyID: keyID})
+}
+
+// PutIf stores the value only if the key is at revision rev, zero rev means the key must not exist.
+func (b *Batch) PutIf(keyID string, rev uint64, data []byte) *Batch {
+	return b.add(BatchOp{Op: BatchOpPut, KeyID: keyID, Data: data, ExpectedRev: &rev})
+}
+
+// DeleteIf deletes the key only if it is at revision rev.
+func (b *Batch) DeleteIf(keyID string, rev uint64) *Batch {
+	return b.add(BatchOp{Op: BatchOpDelete, KeyID: keyID, ExpectedRev: &rev})
+}
+
+func (b *Batch) add(op BatchOp) *Batch {
+	b.ops = append(b.ops, op)
+	return b
+}
+
+// Commit sends the batch. If any operation fails nothing is applied and *BatchError is returned.
+func (b *Batch) Commit() ([]BatchResult, error) {
+	if len(b.ops) == 0 {
+		return nil, errors.New("empty batch")
+	}
+
+	data, err := json.Marshal(b.ops)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal batch: %w", err)
+	}
+
+	if len(data) > maxChannelBytes-1024 {
+		return nil, fmt.Errorf("batch is too large: %d bytes", len(data))
+	}
+
+	rsp, err := b.c.ch.Call("batch", &BatchReqMsg{
+		Namespace: b.namespace,
+		Data:      data,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	batchRsp, ok := rsp.(*BatchRspMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexptected response type %T", rsp)
+	}
+
+	var out BatchRsp
+	if err := json.Unmarshal(batchRsp.Data, &out); err != nil {
+		return nil, fmt.Errorf("invalid batch response: %w", err)
+	}
+
+	if len(out.Results) != len(b.ops) {
+		return nil, fmt.Errorf("unexpected number of results: %d (expected) != %d (actual)", len(b.ops), len(out.Results))
+	}
+
+	if !out.Applied {
+		return out.Results, &BatchError{Results: out.Results}
+	}
+
+	return out.Results, nil
+}
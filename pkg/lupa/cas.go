@@ -0,0 +1,86 @@
+package lupa
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultUpdateAttempts is the number of attempts Update makes when 0 is given.
+const DefaultUpdateAttempts = 5
+
+// GetRev returns the value of the key along with its revision, see CompareAndSwap.
+func (c *Client) GetRev(keyID string) ([]byte, uint64, error) {
+	rsp, err := c.ch.Call("get-rev", &GetReqMsg{
+		KeyID: keyID,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	getRsp, ok := rsp.(*GetRevRspMsg)
+	if !ok {
+		return nil, 0, fmt.Errorf("unexptected response type %T", rsp)
+	}
+
+	return getRsp.Data, getRsp.Rev, nil
+}
+
+// CompareAndSwap stores data under keyID only if the key is still at revision rev and returns the new revision.
+// Zero rev creates a key which must not exist yet.
+// If the key was changed meanwhile the error matches ErrConflict.
+func (c *Client) CompareAndSwap(keyID string, rev uint64, data []byte) (uint64, error) {
+	rsp, err := c.ch.Call("cas", &CASReqMsg{
+		KeyID: keyID,
+		Rev:   rev,
+		Data:  data,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	casRsp, ok := rsp.(*CASRspMsg)
+	if !ok {
+		return 0, fmt.Errorf("unexptected response type %T", rsp)
+	}
+
+	return casRsp.Rev, nil
+}
+
+// Update does a read-modify-write of the existing key: fn gets the current value and returns the new one,
+// which is stored only if nobody changed the key meanwhile. Otherwise fn is called again with the fresh value,
+// up to attempts times (DefaultUpdateAttempts if zero). Returns the new revision of the key.
+//
+//	rev, err := client.Update(keyID, 0, func(cur []byte) ([]byte, error) {
+//		return rotate(cur)
+//	})
+func (c *Client) Update(keyID string, attempts int, fn func(data []byte) ([]byte, error)) (uint64, error) {
+	if attempts <= 0 {
+		attempts = DefaultUpdateAttempts
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		var data []byte
+		var rev uint64
+		data, rev, err = c.GetRev(keyID)
+		if err != nil {
+			return 0, err
+		}
+
+		data, err = fn(data)
+		if err != nil {
+			return 0, err
+		}
+
+		rev, err = c.CompareAndSwap(keyID, rev, data)
+		if err == nil {
+			return rev, nil
+		}
+
+		if !errors.Is(err, ErrConflict) {
+			return 0, err
+		}
+	}
+
+	return 0, fmt.Errorf("update failed after %d attempts: %w", attempts, err)
+}
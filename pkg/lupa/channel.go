@@ -64,7 +64,14 @@ func (c *Channel) ProcessRequest(fn func(string, interface{}) (interface{}, erro
 		}
 
 		rsp, err := fn(callMsg.Type, req)
-		if err != nil {
+		var codedErr *Error
+		switch {
+		case errors.As(err, &codedErr):
+			rsp = &ErrorMsg{
+				Code: uint32(codedErr.Code),
+				Msg:  err.Error(),
+			}
+		case err != nil:
 			rsp = &FailureMsg{
 				Msg: err.Error(),
 			}
@@ -112,8 +119,14 @@ func (c *Channel) Call(typ string, req interface{}) (reply interface{}, err erro
 		return nil, fmt.Errorf("unexpected response: %w", err)
 	}
 
-	if fail, ok := reply.(*FailureMsg); ok {
-		return nil, fmt.Errorf("remote error: %s", fail.Msg)
+	switch r := reply.(type) {
+	case *FailureMsg:
+		return nil, fmt.Errorf("remote error: %s", r.Msg)
+	case *ErrorMsg:
+		return nil, fmt.Errorf("remote error: %w", &Error{
+			Code: ErrorCode(r.Code),
+			Msg:  r.Msg,
+		})
 	}
 
 	return reply, nil
@@ -0,0 +1,31 @@
+package lupa
+
+// ErrorCode classifies remote errors callers may want to handle.
+type ErrorCode uint32
+
+const (
+	ErrCodeConflict ErrorCode = 1
+)
+
+// ErrConflict matches remote errors of a compare-and-swap update that lost the race:
+//
+//	if errors.Is(err, lupa.ErrConflict) {
+//		// re-read and retry
+//	}
+var ErrConflict = &Error{Code: ErrCodeConflict, Msg: "revision conflict"}
+
+// Error is a remote error with a code.
+type Error struct {
+	Code ErrorCode
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// Is reports errors of the same code as equal.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
@@ -0,0 +1,60 @@
+package lupa
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// KeyInfo describes a stored key without its value, zero ReadsLeft means unlimited reads.
+type KeyInfo struct {
+	KeyID     string     `json:"key_id"`
+	Rev       uint64     `json:"rev"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	ReadsLeft uint32     `json:"reads_left,omitempty"`
+}
+
+// Keys lists the machine keys or, with namespace, the readable keys of the shared namespace.
+func (c *Client) Keys(namespace string) ([]KeyInfo, error) {
+	out := make([]KeyInfo, 0)
+	var after string
+	for {
+		rsp, err := c.ch.Call("keys", &ListKeysReqMsg{
+			Namespace: namespace,
+			After:     after,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		keysRsp, ok := rsp.(*KeysRspMsg)
+		if !ok {
+			return nil, fmt.Errorf("unexptected response type %T", rsp)
+		}
+
+		var keys []KeyInfo
+		if err := json.Unmarshal(keysRsp.Data, &keys); err != nil {
+			return nil, fmt.Errorf("invalid keys: %w", err)
+		}
+
+		out = append(out, keys...)
+		if keysRsp.Next == "" {
+			return out, nil
+		}
+
+		if keysRsp.Next <= after {
+			return nil, fmt.Errorf("invalid next page key %q", keysRsp.Next)
+		}
+		after = keysRsp.Next
+	}
+}
+
+// Store stores a single item like PutMany does and returns its key ID.
+func (c *Client) Store(namespace string, item PutItem) (string, error) {
+	keyIDs, err := c.PutMany(namespace, []PutItem{item})
+	if err != nil {
+		return "", err
+	}
+
+	return keyIDs[0], nil
+}
@@ -1,13 +1,20 @@
 package lupa
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
 type Client struct {
-	ch *Channel
+	ch        *Channel
+	sessionID []byte
 }
 
 func NewClient(sshc *ssh.Client) (*Client, error) {
@@ -20,7 +27,8 @@ func NewClient(sshc *ssh.Client) (*Client, error) {
 	go ssh.DiscardRequests(reqs)
 
 	return &Client{
-		ch: NewChannel(ch),
+		ch:        NewChannel(ch),
+		sessionID: sshc.SessionID(),
 	}, nil
 }
 
@@ -56,6 +64,350 @@ func (c *Client) Put(data []byte) (string, error) {
 	return putRsp.KeyID, nil
 }
 
+// Ping performs a no-op request and returns its round trip time.
+func (c *Client) Ping() (time.Duration, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+
+	start := time.Now()
+	rsp, err := c.ch.Call("ping", &PingReqMsg{
+		Nonce: nonce,
+	})
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+
+	pingRsp, ok := rsp.(*PingRspMsg)
+	if !ok {
+		return 0, fmt.Errorf("unexptected response type %T", rsp)
+	}
+
+	if !bytes.Equal(pingRsp.Nonce, nonce) {
+		return 0, errors.New("ping nonce mismatch")
+	}
+
+	return rtt, nil
+}
+
+// PutShared stores data under keyID in a shared namespace and returns its full key id.
+func (c *Client) PutShared(namespace string, keyID string, data []byte) (string, error) {
+	rsp, err := c.ch.Call("put-shared", &PutSharedReqMsg{
+		Namespace: namespace,
+		KeyID:     keyID,
+		Data:      data,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	putRsp, ok := rsp.(*PutRspMsg)
+	if !ok {
+		return "", fmt.Errorf("unexptected response type %T", rsp)
+	}
+
+	return putRsp.KeyID, nil
+}
+
+// Migrate re-homes the secrets, labels and source restrictions of the current machine under the fingerprint of newKey.
+func (c *Client) Migrate(newKey ssh.Signer) (fromFP string, toFP string, err error) {
+	if len(c.sessionID) == 0 {
+		return "", "", errors.New("no SSH session id available")
+	}
+
+	toFP = ssh.FingerprintSHA256(newKey.PublicKey())
+	sig, err := newKey.Sign(rand.Reader, MigrationPayload(c.sessionID, toFP))
+	if err != nil {
+		return "", "", fmt.Errorf("unable to sign migration request: %w", err)
+	}
+
+	rsp, err := c.ch.Call("migrate", &MigrateReqMsg{
+		NewPubKey: newKey.PublicKey().Marshal(),
+		Signature: ssh.Marshal(sig),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	migrateRsp, ok := rsp.(*MigrateRspMsg)
+	if !ok {
+		return "", "", fmt.Errorf("unexptected response type %T", rsp)
+	}
+
+	return migrateRsp.FromFP, migrateRsp.ToFP, nil
+}
+
+// AdminMigrate re-homes the secrets, labels and source restrictions of machine fromFP under toFP. Requires admin role.
+func (c *Client) AdminMigrate(fromFP, toFP string) error {
+	rsp, err := c.ch.Call("admin-migrate", &AdminMigrateReqMsg{
+		FromFP: fromFP,
+		ToFP:   toFP,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, ok := rsp.(*MigrateRspMsg); !ok {
+		return fmt.Errorf("unexptected response type %T", rsp)
+	}
+
+	return nil
+}
+
+// Revoke adds a fingerprint, certificate serial or certificate to the server revocation list.
+// Requires admin role.
+func (c *Client) Revoke(kind string, value string) error {
+	return c.callSuccess("admin-revoke", &RevokeReqMsg{
+		Kind:  kind,
+		Value: value,
+	})
+}
+
+// Unrevoke removes an entry from the server revocation list. Requires admin role.
+func (c *Client) Unrevoke(kind string, value string) error {
+	return c.callSuccess("admin-unrevoke", &RevokeReqMsg{
+		Kind:  kind,
+		Value: value,
+	})
+}
+
+// Revocations lists the server revocation list entries, optionally filtered by kind.
+// Requires admin role.
+func (c *Client) Revocations(kind string) ([]string, error) {
+	rsp, err := c.ch.Call("admin-revocations", &ListRevocationsReqMsg{
+		Kind: kind,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	listRsp, ok := rsp.(*RevocationsRspMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexptected response type %T", rsp)
+	}
+
+	return listRsp.Entries, nil
+}
+
+// SetPolicy creates or replaces a shared namespace access rule. Requires admin role.
+func (c *Client) SetPolicy(rule PolicyRule) error {
+	for _, v := range append(append([]string(nil), rule.Subjects...), rule.Prefixes...) {
+		if strings.Contains(v, ",") {
+			return fmt.Errorf("invalid rule value %q: commas are not allowed", v)
+		}
+	}
+
+	return c.callSuccess("admin-policy-set", &SetPolicyReqMsg{
+		Name:      rule.Name,
+		Namespace: rule.Namespace,
+		Subjects:  rule.Subjects,
+		Prefixes:  rule.Prefixes,
+		Read:      rule.Read,
+		Write:     rule.Write,
+	})
+}
+
+// DeletePolicy removes a shared namespace access rule. Requires admin role.
+func (c *Client) DeletePolicy(name string) error {
+	return c.callSuccess("admin-policy-delete", &DeletePolicyReqMsg{
+		Name: name,
+	})
+}
+
+// Policies returns access rules, optionally filtered by namespace, and machine labels.
+// Requires admin role.
+func (c *Client) Policies(namespace string) (*Policies, error) {
+	rsp, err := c.ch.Call("admin-policies", &ListPoliciesReqMsg{
+		Namespace: namespace,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	policiesRsp, ok := rsp.(*PoliciesRspMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexptected response type %T", rsp)
+	}
+
+	var out Policies
+	if err := json.Unmarshal(policiesRsp.Data, &out); err != nil {
+		return nil, fmt.Errorf("invalid policies: %w", err)
+	}
+
+	return &out, nil
+}
+
+// SetLabels replaces labels of the machine, no labels removes them. Requires admin role.
+func (c *Client) SetLabels(machineFP string, labels []string) error {
+	for _, label := range labels {
+		if strings.Contains(label, ",") {
+			return fmt.Errorf("invalid label %q: commas are not allowed", label)
+		}
+	}
+
+	return c.callSuccess("admin-labels-set", &SetLabelsReqMsg{
+		MachineFP: machineFP,
+		Labels:    labels,
+	})
+}
+
+// SetSources replaces the source address allowlist of the machine. Requires admin role.
+func (c *Client) SetSources(machineFP string, cidrs []string) error {
+	return c.callSuccess("admin-sources-set", &SetSourcesReqMsg{
+		MachineFP: machineFP,
+		CIDRs:     cidrs,
+	})
+}
+
+// UnpinSource forgets the network the machine was pinned to. Requires admin role.
+func (c *Client) UnpinSource(machineFP string) error {
+	return c.callSuccess("admin-sources-unpin", &UnpinSourceReqMsg{
+		MachineFP: machineFP,
+	})
+}
+
+// Sources returns source restrictions of all machines or only of the given one.
+// Requires admin role.
+func (c *Client) Sources(machineFP string) (map[string]MachineSources, error) {
+	rsp, err := c.ch.Call("admin-sources", &ListSourcesReqMsg{
+		MachineFP: machineFP,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sourcesRsp, ok := rsp.(*SourcesRspMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexptected response type %T", rsp)
+	}
+
+	var out map[string]MachineSources
+	if err := json.Unmarshal(sourcesRsp.Data, &out); err != nil {
+		return nil, fmt.Errorf("invalid machine sources: %w", err)
+	}
+
+	return out, nil
+}
+
+// Bans returns currently banned source addresses, optionally only the given one.
+// Requires admin role.
+func (c *Client) Bans(addr string) ([]Ban, error) {
+	rsp, err := c.ch.Call("admin-bans", &ListBansReqMsg{
+		Addr: addr,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bansRsp, ok := rsp.(*BansRspMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexptected response type %T", rsp)
+	}
+
+	var out []Ban
+	if err := json.Unmarshal(bansRsp.Data, &out); err != nil {
+		return nil, fmt.Errorf("invalid bans: %w", err)
+	}
+
+	return out, nil
+}
+
+// Unban lifts the ban of the source address. Requires admin role.
+func (c *Client) Unban(addr string) error {
+	return c.callSuccess("admin-unban", &UnbanReqMsg{
+		Addr: addr,
+	})
+}
+
+// PutMany atomically stores multiple values: either all of them are stored or none.
+// Without namespace values are stored for the machine and names are only used to match the returned key IDs,
+// within namespace names are key names. Returns key IDs in the order of items.
+func (c *Client) PutMany(namespace string, items []PutItem) ([]string, error) {
+	data, err := json.Marshal(items)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal items: %w", err)
+	}
+
+	if len(data) > maxChannelBytes-1024 {
+		return nil, fmt.Errorf("items are too large: %d bytes", len(data))
+	}
+
+	rsp, err := c.ch.Call("put-many", &PutManyReqMsg{
+		Namespace: namespace,
+		Data:      data,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	putRsp, ok := rsp.(*PutManyRspMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexptected response type %T", rsp)
+	}
+
+	var out []string
+	if err := json.Unmarshal(putRsp.Data, &out); err != nil {
+		return nil, fmt.Errorf("invalid key IDs: %w", err)
+	}
+
+	if len(out) != len(items) {
+		return nil, fmt.Errorf("unexpected number of key IDs: %d (expected) != %d (actual)", len(items), len(out))
+	}
+
+	return out, nil
+}
+
+// AuditQuery returns a page of the audit records matching the query and the cursor of the next page,
+// zero cursor means there are no more records. Requires admin role.
+func (c *Client) AuditQuery(q AuditQuery) ([]AuditRecord, uint64, error) {
+	req := &AuditQueryReqMsg{
+		MachineFP: q.MachineFP,
+		KeyID:     q.KeyID,
+		Type:      q.Type,
+		Outcome:   q.Outcome,
+		Cursor:    q.Cursor,
+		Limit:     q.Limit,
+	}
+	if !q.Since.IsZero() {
+		req.Since = uint64(q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		req.Until = uint64(q.Until.UnixNano())
+	}
+
+	rsp, err := c.ch.Call("admin-audit", req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	auditRsp, ok := rsp.(*AuditQueryRspMsg)
+	if !ok {
+		return nil, 0, fmt.Errorf("unexptected response type %T", rsp)
+	}
+
+	var out []AuditRecord
+	if err := json.Unmarshal(auditRsp.Data, &out); err != nil {
+		return nil, 0, fmt.Errorf("invalid audit records: %w", err)
+	}
+
+	return out, auditRsp.NextCursor, nil
+}
+
 func (c *Client) Close() error {
 	return c.ch.Close()
 }
+
+func (c *Client) callSuccess(typ string, req interface{}) error {
+	rsp, err := c.ch.Call(typ, req)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := rsp.(*SuccessMsg); !ok {
+		return fmt.Errorf("unexptected response type %T", rsp)
+	}
+
+	return nil
+}
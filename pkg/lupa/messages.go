@@ -20,7 +20,10 @@ type FailureMsg struct {
 
 const successMsgType = 101
 
-type SuccessMsg struct{}
+type SuccessMsg struct {
+	// Reserved only carries the message type, ssh.Marshal skips tags of field-less structs
+	Reserved []byte `sshtype:"101" ssh:"rest"`
+}
 
 const putReqMsgType = 110
 
@@ -46,6 +49,241 @@ type GetRspMsg struct {
 	Data []byte `sshtype:"113"`
 }
 
+const migrateReqMsgType = 114
+
+type MigrateReqMsg struct {
+	NewPubKey []byte `sshtype:"114"`
+	Signature []byte
+}
+
+const migrateRspMsgType = 115
+
+type MigrateRspMsg struct {
+	FromFP string `sshtype:"115"`
+	ToFP   string
+}
+
+const adminMigrateReqMsgType = 116
+
+type AdminMigrateReqMsg struct {
+	FromFP string `sshtype:"116"`
+	ToFP   string
+}
+
+const revokeReqMsgType = 117
+
+type RevokeReqMsg struct {
+	Kind  string `sshtype:"117"`
+	Value string
+}
+
+const listRevocationsReqMsgType = 118
+
+type ListRevocationsReqMsg struct {
+	Kind string `sshtype:"118"`
+}
+
+const revocationsRspMsgType = 119
+
+type RevocationsRspMsg struct {
+	Entries []string `sshtype:"119"`
+}
+
+const putSharedReqMsgType = 120
+
+type PutSharedReqMsg struct {
+	Namespace string `sshtype:"120"`
+	KeyID     string
+	Data      []byte
+}
+
+const setPolicyReqMsgType = 121
+
+type SetPolicyReqMsg struct {
+	Name      string `sshtype:"121"`
+	Namespace string
+	Subjects  []string
+	Prefixes  []string
+	Read      bool
+	Write     bool
+}
+
+const deletePolicyReqMsgType = 122
+
+type DeletePolicyReqMsg struct {
+	Name string `sshtype:"122"`
+}
+
+const listPoliciesReqMsgType = 123
+
+type ListPoliciesReqMsg struct {
+	Namespace string `sshtype:"123"`
+}
+
+const policiesRspMsgType = 124
+
+type PoliciesRspMsg struct {
+	// Data is JSON encoded Policies
+	Data []byte `sshtype:"124"`
+}
+
+const setLabelsReqMsgType = 125
+
+type SetLabelsReqMsg struct {
+	MachineFP string `sshtype:"125"`
+	Labels    []string
+}
+
+const setSourcesReqMsgType = 126
+
+type SetSourcesReqMsg struct {
+	MachineFP string `sshtype:"126"`
+	CIDRs     []string
+}
+
+const unpinSourceReqMsgType = 127
+
+type UnpinSourceReqMsg struct {
+	MachineFP string `sshtype:"127"`
+}
+
+const listSourcesReqMsgType = 128
+
+type ListSourcesReqMsg struct {
+	MachineFP string `sshtype:"128"`
+}
+
+const sourcesRspMsgType = 129
+
+type SourcesRspMsg struct {
+	// Data is JSON encoded map of machine fingerprint to MachineSources
+	Data []byte `sshtype:"129"`
+}
+
+const listBansReqMsgType = 130
+
+type ListBansReqMsg struct {
+	Addr string `sshtype:"130"`
+}
+
+const bansRspMsgType = 131
+
+type BansRspMsg struct {
+	// Data is JSON encoded list of Ban
+	Data []byte `sshtype:"131"`
+}
+
+const unbanReqMsgType = 132
+
+type UnbanReqMsg struct {
+	Addr string `sshtype:"132"`
+}
+
+const pingReqMsgType = 133
+
+type PingReqMsg struct {
+	Nonce []byte `sshtype:"133"`
+}
+
+const pingRspMsgType = 134
+
+type PingRspMsg struct {
+	Nonce []byte `sshtype:"134"`
+}
+
+const auditQueryReqMsgType = 135
+
+type AuditQueryReqMsg struct {
+	MachineFP string `sshtype:"135"`
+	KeyID     string
+	Type      string
+	Outcome   string
+	Since     uint64
+	Until     uint64
+	Cursor    uint64
+	Limit     uint32
+}
+
+const auditQueryRspMsgType = 136
+
+type AuditQueryRspMsg struct {
+	Data       []byte `sshtype:"136"`
+	NextCursor uint64
+}
+
+const putManyReqMsgType = 137
+
+type PutManyReqMsg struct {
+	Namespace string `sshtype:"137"`
+	Data      []byte
+}
+
+const putManyRspMsgType = 138
+
+type PutManyRspMsg struct {
+	Data []byte `sshtype:"138"`
+}
+
+const batchReqMsgType = 139
+
+type BatchReqMsg struct {
+	Namespace string `sshtype:"139"`
+	Data      []byte
+}
+
+const batchRspMsgType = 140
+
+type BatchRspMsg struct {
+	Data []byte `sshtype:"140"`
+}
+
+const getRevRspMsgType = 141
+
+type GetRevRspMsg struct {
+	Data []byte `sshtype:"141"`
+	Rev  uint64
+}
+
+const casReqMsgType = 142
+
+type CASReqMsg struct {
+	KeyID string `sshtype:"142"`
+	Rev   uint64
+	Data  []byte
+}
+
+const casRspMsgType = 143
+
+type CASRspMsg struct {
+	KeyID string `sshtype:"143"`
+	Rev   uint64
+}
+
+const errorMsgType = 144
+
+// ErrorMsg is a FailureMsg with an error code
+type ErrorMsg struct {
+	Code uint32 `sshtype:"144"`
+	Msg  string
+}
+
+const listKeysReqMsgType = 145
+
+type ListKeysReqMsg struct {
+	Namespace string `sshtype:"145"`
+	// After is the key ID after which keys are listed
+	After string
+}
+
+const keysRspMsgType = 146
+
+type KeysRspMsg struct {
+	// Data is JSON encoded list of KeyInfo
+	Data []byte `sshtype:"146"`
+	// Next is the After of the next page, empty on the last one
+	Next string
+}
+
 func UnmarshalMsg(packet []byte) (interface{}, error) {
 	if len(packet) < 1 {
 		return nil, errors.New("empty packet")
@@ -65,6 +303,72 @@ func UnmarshalMsg(packet []byte) (interface{}, error) {
 		msg = new(GetReqMsg)
 	case getRspMsgType:
 		msg = new(GetRspMsg)
+	case migrateReqMsgType:
+		msg = new(MigrateReqMsg)
+	case migrateRspMsgType:
+		msg = new(MigrateRspMsg)
+	case adminMigrateReqMsgType:
+		msg = new(AdminMigrateReqMsg)
+	case revokeReqMsgType:
+		msg = new(RevokeReqMsg)
+	case listRevocationsReqMsgType:
+		msg = new(ListRevocationsReqMsg)
+	case revocationsRspMsgType:
+		msg = new(RevocationsRspMsg)
+	case putSharedReqMsgType:
+		msg = new(PutSharedReqMsg)
+	case setPolicyReqMsgType:
+		msg = new(SetPolicyReqMsg)
+	case deletePolicyReqMsgType:
+		msg = new(DeletePolicyReqMsg)
+	case listPoliciesReqMsgType:
+		msg = new(ListPoliciesReqMsg)
+	case policiesRspMsgType:
+		msg = new(PoliciesRspMsg)
+	case setLabelsReqMsgType:
+		msg = new(SetLabelsReqMsg)
+	case setSourcesReqMsgType:
+		msg = new(SetSourcesReqMsg)
+	case unpinSourceReqMsgType:
+		msg = new(UnpinSourceReqMsg)
+	case listSourcesReqMsgType:
+		msg = new(ListSourcesReqMsg)
+	case sourcesRspMsgType:
+		msg = new(SourcesRspMsg)
+	case listBansReqMsgType:
+		msg = new(ListBansReqMsg)
+	case bansRspMsgType:
+		msg = new(BansRspMsg)
+	case unbanReqMsgType:
+		msg = new(UnbanReqMsg)
+	case pingReqMsgType:
+		msg = new(PingReqMsg)
+	case pingRspMsgType:
+		msg = new(PingRspMsg)
+	case auditQueryReqMsgType:
+		msg = new(AuditQueryReqMsg)
+	case auditQueryRspMsgType:
+		msg = new(AuditQueryRspMsg)
+	case putManyReqMsgType:
+		msg = new(PutManyReqMsg)
+	case putManyRspMsgType:
+		msg = new(PutManyRspMsg)
+	case batchReqMsgType:
+		msg = new(BatchReqMsg)
+	case batchRspMsgType:
+		msg = new(BatchRspMsg)
+	case getRevRspMsgType:
+		msg = new(GetRevRspMsg)
+	case casReqMsgType:
+		msg = new(CASReqMsg)
+	case casRspMsgType:
+		msg = new(CASRspMsg)
+	case errorMsgType:
+		msg = new(ErrorMsg)
+	case listKeysReqMsgType:
+		msg = new(ListKeysReqMsg)
+	case keysRspMsgType:
+		msg = new(KeysRspMsg)
 	default:
 		return nil, fmt.Errorf("agent: unknown type tag %d", packet[0])
 	}
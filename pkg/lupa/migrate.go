@@ -0,0 +1,21 @@
+package lupa
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+const migrationSigMagic = "lupa-migrate-v1"
+
+// MigrationPayload returns the data a machine must sign with its new key to prove
+// possession of it. It is bound to the SSH session, so a signature can't be replayed.
+func MigrationPayload(sessionID []byte, toFP string) []byte {
+	return ssh.Marshal(struct {
+		Magic     string
+		SessionID []byte
+		ToFP      string
+	}{
+		Magic:     migrationSigMagic,
+		SessionID: sessionID,
+		ToFP:      toFP,
+	})
+}
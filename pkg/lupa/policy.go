@@ -0,0 +1,29 @@
+package lupa
+
+import "strings"
+
+// SharedKeyID returns the key id of a key stored in a shared namespace.
+func SharedKeyID(namespace string, keyID string) string {
+	return namespace + "/" + keyID
+}
+
+// SplitSharedKeyID splits a shared namespace key id, ok is false for machine own keys.
+func SplitSharedKeyID(keyID string) (namespace string, key string, ok bool) {
+	return strings.Cut(keyID, "/")
+}
+
+// PolicyRule grants subjects ("fp:<fingerprint>", "label:<label>" or "principal:<principal>")
+// access to keys with given prefixes in a shared namespace.
+type PolicyRule struct {
+	Name      string   `json:"name"`
+	Namespace string   `json:"namespace"`
+	Subjects  []string `json:"subjects"`
+	Prefixes  []string `json:"prefixes"`
+	Read      bool     `json:"read"`
+	Write     bool     `json:"write"`
+}
+
+type Policies struct {
+	Rules  []PolicyRule        `json:"rules"`
+	Labels map[string][]string `json:"labels"`
+}
@@ -0,0 +1,48 @@
+package lupa
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"text/template"
+)
+
+// Render executes text/template with secrets fetched by the client:
+//
+//	{{ lupa "keyID" }}           - secret value
+//	{{ lupa "keyID" | base64 }}  - base64 encoded value
+//
+// Each referenced secret is fetched once, any unavailable secret fails the whole rendering.
+func (c *Client) Render(name string, text string) ([]byte, error) {
+	secrets := make(map[string]string)
+	funcs := template.FuncMap{
+		"lupa": func(keyID string) (string, error) {
+			if data, ok := secrets[keyID]; ok {
+				return data, nil
+			}
+
+			data, err := c.Get(keyID)
+			if err != nil {
+				return "", fmt.Errorf("unable to get key %q: %w", keyID, err)
+			}
+
+			secrets[keyID] = string(data)
+			return string(data), nil
+		},
+		"base64": func(in string) string {
+			return base64.StdEncoding.EncodeToString([]byte(in))
+		},
+	}
+
+	tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, nil); err != nil {
+		return nil, fmt.Errorf("unable to render template: %w", err)
+	}
+
+	return out.Bytes(), nil
+}
@@ -0,0 +1,7 @@
+package lupa
+
+// MachineSources are source address restrictions of a registered machine.
+type MachineSources struct {
+	Allowed []string `json:"allowed,omitempty"`
+	Pinned  string   `json:"pinned,omitempty"`
+}